@@ -1,9 +1,11 @@
 package extsort_test
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/bsm/extsort"
+	"github.com/bsm/extsort/testutil"
 )
 
 func BenchmarkSorter(b *testing.B) {
@@ -48,3 +50,86 @@ func BenchmarkSorter(b *testing.B) {
 		b.Fatal(err)
 	}
 }
+
+func BenchmarkIterator_highFanIn(b *testing.B) {
+	sorter := extsort.New(&extsort.Options{
+		BufferSize: 64 * 1024,
+	})
+	defer sorter.Close()
+
+	// about 200 runs
+	for i := 0; i < 200*4096; i++ {
+		if err := sorter.Append([]byte(fmt.Sprintf("%08x", (i*7919)%(200*4096)))); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	iter, err := sorter.Sort()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer iter.Close()
+
+	cursor := iter.Cursor()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if !iter.Next() {
+			b.StopTimer()
+			if err := iter.ResumeFrom(cursor); err != nil {
+				b.Fatal(err)
+			}
+			b.StartTimer()
+		}
+	}
+	if err := iter.Err(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkSorter_Sort(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		sorter := extsort.New(&extsort.Options{
+			BufferSize: 1024 * 1024,
+		})
+		if err := testutil.FeedSorter(sorter, 100000, 16, 33); err != nil {
+			b.Fatal(err)
+		}
+
+		iter, err := sorter.Sort()
+		if err != nil {
+			b.Fatal(err)
+		}
+		for iter.Next() {
+		}
+		if err := iter.Err(); err != nil {
+			b.Fatal(err)
+		}
+		_ = iter.Close()
+		_ = sorter.Close()
+	}
+}
+
+func BenchmarkSorter_smallRuns(b *testing.B) {
+	keys := testutil.GenerateKeys(16*1024, 16, 33)
+	for _, threshold := range []int{0, 12, 32} {
+		b.Run(fmt.Sprintf("threshold=%d", threshold), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				sorter := extsort.New(&extsort.Options{
+					BufferSize:         64 * 1024,
+					SmallSortThreshold: threshold,
+				})
+				if err := sorter.AppendAll(keys); err != nil {
+					b.Fatal(err)
+				}
+
+				iter, err := sorter.Sort()
+				if err != nil {
+					b.Fatal(err)
+				}
+				_ = iter.Close()
+				_ = sorter.Close()
+			}
+		})
+	}
+}
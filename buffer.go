@@ -1,34 +1,203 @@
 package extsort
 
 import (
+	"bytes"
 	"container/heap"
 	"sort"
 )
 
+// DefaultSort is the default sort function used for runs, see Options.Sort.
+func DefaultSort(data sort.Interface) {
+	sort.Sort(data)
+}
+
+// HybridSort returns a sort function which uses quicksort for large ranges
+// and switches to insertion sort for ranges of up to threshold items. It
+// falls back to sort.Sort on degenerate input. See
+// Options.SmallSortThreshold.
+func HybridSort(threshold int) func(sort.Interface) {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return func(data sort.Interface) {
+		n := data.Len()
+		depth := 0
+		for i := n; i > 0; i >>= 1 {
+			depth += 2
+		}
+		hybridSort(data, 0, n, threshold, depth)
+	}
+}
+
+func hybridSort(data sort.Interface, lo, hi, threshold, depth int) {
+	for hi-lo > threshold {
+		if depth == 0 {
+			sort.Sort(subRange{data: data, lo: lo, hi: hi})
+			return
+		}
+		depth--
+
+		p := partition(data, lo, hi)
+		if p-lo < hi-p {
+			hybridSort(data, lo, p, threshold, depth)
+			lo = p + 1
+		} else {
+			hybridSort(data, p+1, hi, threshold, depth)
+			hi = p
+		}
+	}
+	for i := lo + 1; i < hi; i++ {
+		for j := i; j > lo && data.Less(j, j-1); j-- {
+			data.Swap(j, j-1)
+		}
+	}
+}
+
+// partition moves the median of three to lo, partitions [lo, hi) around it
+// and returns its final position.
+func partition(data sort.Interface, lo, hi int) int {
+	m := lo + (hi-lo)/2
+	if data.Less(m, lo) {
+		data.Swap(m, lo)
+	}
+	if data.Less(hi-1, m) {
+		data.Swap(hi-1, m)
+		if data.Less(m, lo) {
+			data.Swap(m, lo)
+		}
+	}
+	data.Swap(lo, m)
+
+	p := lo
+	for i := lo + 1; i < hi; i++ {
+		if data.Less(i, lo) {
+			p++
+			data.Swap(p, i)
+		}
+	}
+	data.Swap(lo, p)
+	return p
+}
+
+type subRange struct {
+	data   sort.Interface
+	lo, hi int
+}
+
+func (r subRange) Len() int           { return r.hi - r.lo }
+func (r subRange) Less(i, j int) bool { return r.data.Less(r.lo+i, r.lo+j) }
+func (r subRange) Swap(i, j int)      { r.data.Swap(r.lo+i, r.lo+j) }
+
+// SortSlice sorts data in memory, using less as the compare function.
+// When less is nil, data is sorted lexically.
+func SortSlice(data [][]byte, less Less) {
+	if less == nil {
+		less = stdLess
+	}
+	b := memBuffer{chunks: data, less: less, sortFn: DefaultSort}
+	b.Sort()
+}
+
 type memBuffer struct {
-	size   int
-	chunks [][]byte
-	less   Less
+	size    int
+	chunks  [][]byte
+	less    Less
+	sortFn  func(sort.Interface)
+	sortKey func([]byte) []byte
+	byValue bool
+	growth  float64
+	refs    bool
+}
+
+func newMemBuffer(less Less, opt *Options) *memBuffer {
+	b := &memBuffer{less: less, sortFn: opt.Sort, sortKey: opt.SortKey, growth: opt.GrowthFactor}
+	switch opt.TieBreak {
+	case TieBreakByValue:
+		b.byValue = true
+		b.less = func(a, b []byte) bool {
+			if less(a, b) {
+				return true
+			} else if less(b, a) {
+				return false
+			}
+			return bytes.Compare(a, b) < 0
+		}
+	case TieBreakBySection, TieBreakRoundRobin:
+		b.sortFn = sort.Stable
+	}
+	if opt.ExpectedEntries > 0 {
+		b.chunks = make([][]byte, 0, opt.ExpectedEntries)
+	}
+	return b
 }
 
 func (b *memBuffer) Append(data []byte) {
+	n := b.extend()
+	b.chunks[n] = append(b.chunks[n][:0], data...)
+	b.size += len(data)
+}
+
+// AppendRef appends data by reference, without copying it.
+func (b *memBuffer) AppendRef(data []byte) {
+	n := b.extend()
+	b.chunks[n] = data
+	b.size += len(data)
+	b.refs = true
+}
+
+// extend adds a slot to the buffer and returns its index.
+func (b *memBuffer) extend() int {
 	n := len(b.chunks)
 	if n < cap(b.chunks) {
 		b.chunks = b.chunks[:n+1]
+	} else if b.growth != 0 {
+		b.grow()
+		b.chunks = b.chunks[:n+1]
 	} else {
 		b.chunks = append(b.chunks, nil)
 	}
-	b.chunks[n] = append(b.chunks[n][:0], data...)
-	b.size += len(data)
+	return n
+}
+
+func (b *memBuffer) grow() {
+	n := int(float64(cap(b.chunks)) * b.growth)
+	if min := cap(b.chunks) + 16; n < min {
+		n = min
+	}
+
+	chunks := make([][]byte, len(b.chunks), n)
+	copy(chunks, b.chunks)
+	b.chunks = chunks
 }
 
 func (b *memBuffer) ByteSize() int      { return b.size }
 func (b *memBuffer) Len() int           { return len(b.chunks) }
 func (b *memBuffer) Less(i, j int) bool { return b.less(b.chunks[i], b.chunks[j]) }
 func (b *memBuffer) Swap(i, j int)      { b.chunks[i], b.chunks[j] = b.chunks[j], b.chunks[i] }
-func (b *memBuffer) Sort()              { sort.Sort(b) }
+
+// Sort sorts the buffer, decorating each chunk with its sort key first if
+// Options.SortKey is set.
+func (b *memBuffer) Sort() {
+	if b.sortKey == nil {
+		b.sortFn(b)
+		return
+	}
+
+	d := &decoratedBuffer{chunks: b.chunks, keys: make([][]byte, len(b.chunks)), byValue: b.byValue}
+	for i, data := range b.chunks {
+		d.keys[i] = b.sortKey(data)
+	}
+	b.sortFn(d)
+}
 
 func (b *memBuffer) Reset() {
+	// referenced chunks must not be reused by Append
+	if b.refs {
+		for i := range b.chunks {
+			b.chunks[i] = nil
+		}
+		b.refs = false
+	}
 	b.size = 0
 	b.chunks = b.chunks[:0]
 }
@@ -38,20 +207,73 @@ func (b *memBuffer) Free() {
 	b.chunks = nil
 }
 
+type decoratedBuffer struct {
+	chunks  [][]byte
+	keys    [][]byte
+	byValue bool
+}
+
+func (d *decoratedBuffer) Len() int { return len(d.chunks) }
+func (d *decoratedBuffer) Less(i, j int) bool {
+	c := bytes.Compare(d.keys[i], d.keys[j])
+	if c == 0 && d.byValue {
+		return bytes.Compare(d.chunks[i], d.chunks[j]) < 0
+	}
+	return c < 0
+}
+func (d *decoratedBuffer) Swap(i, j int) {
+	d.chunks[i], d.chunks[j] = d.chunks[j], d.chunks[i]
+	d.keys[i], d.keys[j] = d.keys[j], d.keys[i]
+}
+
 // --------------------------------------------------------------------
 
 type heapItem struct {
 	section int
 	data    []byte
+	key     []byte
+	round   int
 }
 
 type minHeap struct {
-	items []heapItem
-	less  Less
+	items    []heapItem
+	less     Less
+	order    Less // optional, overrides less and sortKey for the heap order
+	sortKey  func([]byte) []byte
+	tieBreak TieBreak
 }
 
-func (h *minHeap) Len() int           { return len(h.items) }
-func (h *minHeap) Less(i, j int) bool { return h.less(h.items[i].data, h.items[j].data) }
+func (h *minHeap) Len() int { return len(h.items) }
+func (h *minHeap) Less(i, j int) bool {
+	a, b := h.items[i], h.items[j]
+	less := h.less
+	if h.order != nil {
+		less = h.order
+	}
+
+	if h.sortKey != nil && h.order == nil {
+		if c := bytes.Compare(a.key, b.key); c != 0 || h.tieBreak == TieBreakUndefined {
+			return c < 0
+		}
+	} else if h.tieBreak == TieBreakUndefined {
+		return less(a.data, b.data)
+	} else if less(a.data, b.data) {
+		return true
+	} else if less(b.data, a.data) {
+		return false
+	}
+	switch h.tieBreak {
+	case TieBreakByValue:
+		if c := bytes.Compare(a.data, b.data); c != 0 {
+			return c < 0
+		}
+	case TieBreakRoundRobin:
+		if a.round != b.round {
+			return a.round < b.round
+		}
+	}
+	return a.section < b.section
+}
 func (h *minHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
 func (h *minHeap) Push(x interface{}) { h.items = append(h.items, x.(heapItem)) }
 func (h *minHeap) Pop() interface{} {
@@ -62,7 +284,46 @@ func (h *minHeap) Pop() interface{} {
 }
 
 func (h *minHeap) PushData(section int, data []byte) {
-	heap.Push(h, heapItem{section: section, data: data})
+	item := heapItem{section: section, data: data}
+	if h.sortKey != nil {
+		item.key = h.sortKey(data)
+	}
+	heap.Push(h, item)
+}
+
+// Top returns the minimum item without removing it.
+func (h *minHeap) Top() (int, []byte) {
+	ent := h.items[0]
+	return ent.section, ent.data
+}
+
+// ReplaceTop replaces the data of the minimum item and restores the heap
+// order with a single sift.
+func (h *minHeap) ReplaceTop(data []byte) {
+	item := &h.items[0]
+	prev, prevKey := item.data, item.key
+
+	item.data = data
+	if h.sortKey != nil {
+		item.key = h.sortKey(data)
+	}
+
+	// count consecutive equal items per section to rotate among sections
+	if h.tieBreak == TieBreakRoundRobin {
+		var equal bool
+		if h.sortKey != nil {
+			equal = bytes.Equal(prevKey, item.key)
+		} else {
+			equal = !h.less(prev, data)
+		}
+
+		if equal {
+			item.round++
+		} else {
+			item.round = 0
+		}
+	}
+	heap.Fix(h, 0)
 }
 
 func (h *minHeap) PopData() (int, []byte) {
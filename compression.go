@@ -29,13 +29,12 @@ func (c Compression) newReader(r io.Reader) (io.ReadCloser, error) {
 	return plainReader{Reader: r}, nil
 }
 
-func (c Compression) newWriter(w io.Writer) compressedWriter {
+func (c Compression) newWriter(w io.Writer, level int) (compressedWriter, error) {
 	switch c {
 	case CompressionGzip:
-		wr, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
-		return wr
+		return gzip.NewWriterLevel(w, level)
 	}
-	return &plainWriter{Writer: w}
+	return &plainWriter{Writer: w}, nil
 }
 
 type compressedWriter interface {
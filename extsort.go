@@ -1,71 +1,672 @@
 package extsort
 
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrInvalidCursor is returned when a cursor cannot be applied to an iterator.
+	ErrInvalidCursor = errors.New("extsort: invalid cursor")
+	// ErrEmptyData is returned by Append when empty data is rejected.
+	ErrEmptyData = errors.New("extsort: empty data")
+	// ErrDataTooLarge is returned by Append when data exceeds
+	// Options.MaxDataSize.
+	ErrDataTooLarge = errors.New("extsort: data too large")
+	// ErrOrderViolation is returned by Iterator.Err when the output is
+	// detected to be out of order, see Options.DebugAssertions.
+	ErrOrderViolation = errors.New("extsort: order violation")
+	// ErrMemoryLimit is returned by Append when data cannot be buffered
+	// within Options.MemoryLimit, see Options.StrictMemory.
+	ErrMemoryLimit = errors.New("extsort: memory limit exceeded")
+	// ErrTooManyEntries is returned by Iterator.Err when the output exceeds
+	// Options.MaxOutputEntries.
+	ErrTooManyEntries = errors.New("extsort: too many entries")
+	// ErrInvalidEntry is returned by DecodeEntry when an entry has an
+	// invalid length.
+	ErrInvalidEntry = errors.New("extsort: invalid entry")
+	// ErrChecksumUnavailable is returned by Iterator.OutputChecksum when
+	// checksums are disabled or the iteration is not yet complete.
+	ErrChecksumUnavailable = errors.New("extsort: checksum unavailable")
+	// ErrSplitUnsupported is returned by Iterator.SplitRanges when the
+	// output is deduplicated with EqualWithin or DedupWindow.
+	ErrSplitUnsupported = errors.New("extsort: cannot split ranges of grouped duplicates")
+)
+
 // Sorter is responsible for sorting.
 type Sorter struct {
-	opt *Options
-	buf *memBuffer
-	tw  *tempWriter
+	mu sync.Mutex
+
+	opt  *Options
+	less Less
+	buf  *memBuffer
+	tw   *tempWriter
+
+	counters *counters
+
+	runs     []int64
+	numRuns  int
+	sketch   *countMinSketch
+	spilled  bool
+	flushed  bool // a run was written or is being written
+	prepared bool
+
+	spare      *memBuffer
+	pending    chan error
+	pendingLen int64
+
+	ticker    *time.Ticker
+	tickErr   error
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
 }
 
 // New inits a sorter
 func New(opt *Options) *Sorter {
 	opt = opt.norm()
-	return &Sorter{opt: opt, buf: &memBuffer{less: opt.Less}}
+	s := &Sorter{opt: opt, less: opt.Less, counters: &counters{metrics: opt.Metrics}}
+	if opt.CountComparisons {
+		s.less = s.counters.countingLess(opt.Less)
+	}
+	if opt.OnCompare != nil {
+		s.less = observedLess(s.less, opt.OnCompare)
+	}
+	s.buf = newMemBuffer(s.less, opt)
+	if opt.FrequencySketch {
+		s.sketch = new(countMinSketch)
+	}
+	if opt.FlushInterval > 0 {
+		s.ticker = time.NewTicker(opt.FlushInterval)
+		s.done = make(chan struct{})
+		s.stopped = make(chan struct{})
+		go s.loop()
+	}
+	return s
 }
 
 // Append appends a data chunk to the sorter.
 func (s *Sorter) Append(data []byte) error {
-	if sz := s.buf.ByteSize(); sz > 0 && sz+len(data) > s.opt.BufferSize {
-		if err := s.flush(); err != nil {
+	return s.append(data, false)
+}
+
+// AppendRaw appends all records of region to the sorter without copying
+// them. Records are extracted by split, which returns the next record and
+// the rest of the region, or false once no further records remain.
+//
+// The records are buffered by reference until they are flushed to disk,
+// therefore region must remain valid and must not be modified until the
+// sorter is closed.
+func (s *Sorter) AppendRaw(region []byte, split func(region []byte) (rec, rest []byte, ok bool)) error {
+	for len(region) != 0 {
+		rec, rest, ok := split(region)
+		if !ok {
+			break
+		}
+		if err := s.append(rec, true); err != nil {
 			return err
 		}
+		region = rest
+	}
+	return nil
+}
+
+func (s *Sorter) append(data []byte, ref bool) error {
+	if len(data) == 0 && s.opt.RejectEmpty {
+		return ErrEmptyData
+	}
+	if max := s.opt.MaxDataSize; max > 0 && len(data) > max {
+		if !s.opt.TruncateData {
+			return ErrDataTooLarge
+		}
+		data = data[:max]
+	}
+	if s.opt.StrictMemory && !s.CanFit(data) {
+		return ErrMemoryLimit
 	}
 
-	s.buf.Append(data)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.prepare(); err != nil {
+		return err
+	}
+	if err := s.tickErr; err != nil {
+		s.tickErr = nil
+		return err
+	}
+
+	if s.pending != nil {
+		select {
+		case err := <-s.pending:
+			if err := s.settle(err); err != nil {
+				return err
+			}
+		default:
+		}
+	}
+
+	if sz := s.buf.ByteSize(); sz > 0 && sz+len(data) > s.opt.runLimit(!s.flushed) {
+		if err := s.spill(); err != nil {
+			return err
+		}
+	} else if max := s.opt.TargetRunEntries; max > 0 && s.buf.Len() >= max {
+		if err := s.spill(); err != nil {
+			return err
+		}
+	}
+
+	if ref {
+		s.buf.AppendRef(data)
+	} else {
+		s.buf.Append(data)
+	}
+	atomic.AddInt64(&s.counters.appended, int64(len(data)))
+	if s.sketch != nil {
+		s.sketch.Add(data)
+	}
+	return nil
+}
+
+// CanFit reports whether data can be buffered within Options.MemoryLimit,
+// which limits the summed length of all buffered chunks.
+// Since the buffer is flushed before it would exceed the limit, this only
+// depends on the size of data itself. It always returns true unless a
+// MemoryLimit is set.
+func (s *Sorter) CanFit(data []byte) bool {
+	max := s.opt.memoryLimit()
+	return max <= 0 || len(data) <= max
+}
+
+// AppendAll appends multiple data chunks to the sorter. It stops at and
+// returns the first error.
+func (s *Sorter) AppendAll(items [][]byte) error {
+	for _, data := range items {
+		if err := s.Append(data); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 // Sort applies the sort algorithm and returns an interator.
+// Given identical input and options, the output is reproducible, including
+// the relative order of items that compare as equal.
 func (s *Sorter) Sort() (*Iterator, error) {
+	return s.sort(false)
+}
+
+// Unique is like Sort, but removes all duplicates from the output,
+// regardless of Options.DedupScope.
+func (s *Sorter) Unique() (*Iterator, error) {
+	return s.sort(true)
+}
+
+func (s *Sorter) sort(unique bool) (*Iterator, error) {
+	s.stopLoop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.prepare(); err != nil {
+		return nil, err
+	}
+	if err := s.tickErr; err != nil {
+		s.tickErr = nil
+		return nil, err
+	}
 	if err := s.flush(); err != nil {
 		return nil, err
 	}
 
 	// free the write buffer
 	s.buf.Free()
+	s.spare = nil
 
 	// wrap in an iterator
-	return newIterator(s.tw.Name(), s.tw.offsets, s.opt)
+	iter, err := newIterator(s.tw, s.opt, s.less, s.counters)
+	if err != nil {
+		return nil, err
+	}
+	if unique {
+		iter.dedup = true
+	}
+	return iter, nil
+}
+
+// NewIterator returns a new, independent iterator over all data appended
+// so far, flushing buffered data first. Unlike Sort, it can be called
+// repeatedly and the returned iterators can be consumed concurrently.
+// Data appended later is not visible to existing iterators.
+func (s *Sorter) NewIterator() (*Iterator, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.prepare(); err != nil {
+		return nil, err
+	}
+	if err := s.tickErr; err != nil {
+		s.tickErr = nil
+		return nil, err
+	}
+	if err := s.wait(); err != nil {
+		return nil, err
+	}
+	if s.buf.Len() != 0 || s.tw == nil {
+		if err := s.flush(); err != nil {
+			return nil, err
+		}
+	}
+	return newIterator(s.tw, s.opt, s.less, s.counters)
+}
+
+// Finalize merges all runs into a single file at path and returns an
+// iterator over it. Temporary files are removed, but the file at path is
+// retained after the iterator and the sorter are closed. It can be read
+// again with ResumeIterator, using the Offsets and a Snapshot taken before
+// the first call to Next. Finalize must only be called once.
+func (s *Sorter) Finalize(path string) (*Iterator, error) {
+	s.stopLoop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.prepare(); err != nil {
+		return nil, err
+	}
+	if err := s.tickErr; err != nil {
+		s.tickErr = nil
+		return nil, err
+	}
+	if err := s.flush(); err != nil {
+		return nil, err
+	}
+
+	// free the write buffer
+	s.buf.Free()
+	s.spare = nil
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	tw, err := newFileWriter(f, s.opt)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(path)
+		return nil, err
+	}
+	if err := s.mergeInto(tw); err != nil {
+		_ = f.Close()
+		_ = os.Remove(path)
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(path)
+		return nil, err
+	}
+
+	// replace temporary runs
+	if err := s.tw.Close(); err != nil {
+		return nil, err
+	}
+	s.tw = nil
+
+	return newIterator(tw, s.opt, s.less, s.counters)
+}
+
+// Size returns the total number of bytes appended so far. It is cheap
+// and safe to call concurrently.
+func (s *Sorter) Size() int64 {
+	return atomic.LoadInt64(&s.counters.appended)
+}
+
+// RunSizes returns the number of entries in each run flushed so far.
+func (s *Sorter) RunSizes() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sizes := make([]int64, len(s.runs))
+	copy(sizes, s.runs)
+	return sizes
+}
+
+// Stats returns sorting statistics.
+func (s *Sorter) Stats() Stats {
+	return s.counters.Stats()
+}
+
+// Spilled reports whether data had to be spilled to disk in multiple runs
+// before Sort, either because the input exceeded BufferSize or because
+// of the FlushInterval. Please note that Sort always writes the final run
+// to disk too.
+func (s *Sorter) Spilled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.spilled
+}
+
+// Options returns a copy of the effective options, after defaults have
+// been applied.
+func (s *Sorter) Options() Options {
+	return *s.opt
+}
+
+// DedupActive reports whether duplicates are removed by Sort, as
+// configured by Options.DedupScope. See Options.DedupFunc for the equality
+// used.
+func (s *Sorter) DedupActive() bool {
+	return s.opt.DedupScope != DedupNone
+}
+
+// Frequency returns the estimated number of times data was appended.
+// The estimate may be too high, but is never too low. It always returns 0
+// unless Options.FrequencySketch is enabled.
+func (s *Sorter) Frequency(data []byte) uint64 {
+	if s.sketch == nil {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sketch.Count(data)
 }
 
 // Close stops the processing and removes temporary files.
 func (s *Sorter) Close() error {
+	s.stopLoop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.wait()
 	if s.tw != nil {
-		return s.tw.Close()
+		if e := s.tw.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// prepare ensures the work directory exists before it is used.
+func (s *Sorter) prepare() error {
+	if s.prepared {
+		return nil
+	}
+
+	if level := s.opt.CompressionLevel; level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return fmt.Errorf("extsort: invalid compression level %d", level)
+	}
+
+	if dir := s.opt.WorkDir; dir == "" {
+		// use the default temporary directory
+	} else if s.opt.CreateWorkDir {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return err
+		}
+	} else if info, err := os.Stat(dir); os.IsNotExist(err) {
+		return fmt.Errorf("extsort: work dir %s does not exist", dir)
+	} else if err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("extsort: work dir %s is not a directory", dir)
+	}
+
+	s.prepared = true
+	return nil
+}
+
+// loop flushes pending data at every FlushInterval tick.
+func (s *Sorter) loop() {
+	defer close(s.stopped)
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.ticker.C:
+			s.mu.Lock()
+			if s.buf.Len() != 0 {
+				if err := s.spill(); err != nil && s.tickErr == nil {
+					s.tickErr = err
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// stopLoop stops the FlushInterval loop, if running.
+func (s *Sorter) stopLoop() {
+	if s.ticker == nil {
+		return
+	}
+
+	s.closeOnce.Do(func() {
+		s.ticker.Stop()
+		close(s.done)
+		<-s.stopped
+	})
+}
+
+// spill flushes the buffer before Sort, in the background if AsyncFlush is
+// enabled.
+func (s *Sorter) spill() error {
+	flush := s.flush
+	if s.opt.AsyncFlush {
+		flush = s.flushAsync
+	}
+	if err := flush(); err != nil {
+		return err
 	}
+	s.spilled = true
 	return nil
 }
 
 func (s *Sorter) flush() error {
+	if err := s.wait(); err != nil {
+		return err
+	}
+
+	s.flushed = true
+	n, err := s.writeRun(s.buf)
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, n)
+	return nil
+}
+
+// flushAsync hands the buffer over to a background flush and continues
+// with the spare buffer. At most one flush is outstanding at any time.
+func (s *Sorter) flushAsync() error {
+	if err := s.wait(); err != nil {
+		return err
+	}
+
+	buf := s.buf
+	if s.spare == nil {
+		s.spare = newMemBuffer(s.less, s.opt)
+	}
+	s.buf, s.spare = s.spare, buf
+
+	s.flushed = true
+	s.pending = make(chan error, 1)
+	go func() {
+		n, err := s.writeRun(buf)
+		s.pendingLen = n
+		s.pending <- err
+	}()
+	return nil
+}
+
+// wait blocks until the outstanding background flush, if any, completes.
+func (s *Sorter) wait() error {
+	if s.pending == nil {
+		return nil
+	}
+	return s.settle(<-s.pending)
+}
+
+func (s *Sorter) settle(err error) error {
+	s.pending = nil
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, s.pendingLen)
+	return nil
+}
+
+// writeRun sorts and writes the buffer as a single run and returns the
+// number of entries written.
+func (s *Sorter) writeRun(buf *memBuffer) (int64, error) {
 	if s.tw == nil {
-		tw, err := newTempWriter(s.opt.WorkDir, s.opt.Compression)
+		tw, err := newTempWriter(s.opt)
 		if err != nil {
-			return err
+			return 0, err
 		}
 		s.tw = tw
 	}
 
-	s.buf.Sort()
-	for _, data := range s.buf.chunks {
-		if err := s.tw.Encode(data); err != nil {
-			return err
+	if err := s.tw.Use(s.selectCodec(s.numRuns, int64(buf.ByteSize()))); err != nil {
+		return 0, err
+	}
+	s.numRuns++
+
+	buf.Sort()
+
+	// hold back each item until all its duplicates have been seen
+	var prev, first []byte
+	var n int64
+	for i, data := range buf.chunks {
+		if i != 0 && s.opt.DedupScope != DedupNone && s.isDup(prev, first, buf.chunks[i-1], data) {
+			if s.opt.DedupResolve != nil {
+				prev = s.opt.DedupResolve(prev, data)
+			}
+			continue
+		}
+		if i != 0 {
+			if err := s.tw.Encode(prev); err != nil {
+				return 0, err
+			}
+			n++
 		}
+		prev, first = data, data
+	}
+	if len(buf.chunks) != 0 {
+		if err := s.tw.Encode(prev); err != nil {
+			return 0, err
+		}
+		n++
 	}
 	if err := s.tw.Flush(); err != nil {
+		return 0, err
+	}
+	s.counters.trackSection(s.tw)
+	if m := s.opt.Metrics; m != nil {
+		m.IncRuns()
+	}
+	buf.Reset()
+
+	if fn := s.opt.OnRunFlushed; fn != nil {
+		if err := fn(len(s.tw.offsets)-1, s.tw.f, s.tw.offsets, s.tw.codecs); err != nil {
+			return 0, err
+		}
+	}
+
+	if max := s.opt.MergeWhenRuns; max > 0 && len(s.tw.offsets) > max {
+		if err := s.compact(); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// selectCodec returns the compression for a section of size bytes which
+// is written for the given run.
+func (s *Sorter) selectCodec(run int, size int64) Compression {
+	compress := s.opt.Compression
+	if s.opt.SelectCodec != nil {
+		compress = s.opt.SelectCodec(run).norm()
+	}
+	if size < int64(s.opt.CompressMinBytes) {
+		compress = CompressionNone
+	}
+	return compress
+}
+
+// isDup reports whether data duplicates the retained item prev or, with
+// EqualWithin, its immediate predecessor last or, with DedupWindow, the
+// first item of its group.
+func (s *Sorter) isDup(prev, first, last, data []byte) bool {
+	if s.opt.EqualWithin != nil {
+		return s.opt.EqualWithin(last, data)
+	} else if s.opt.DedupWindow != nil {
+		return s.opt.DedupWindow(first, data)
+	}
+	return !s.less(prev, data)
+}
+
+// compact merges all runs written so far into a single run, stored in
+// a new temporary file.
+func (s *Sorter) compact() error {
+	tw, err := newTempWriter(s.opt)
+	if err != nil {
+		return err
+	}
+	if err := s.mergeInto(tw); err != nil {
+		_ = tw.Close()
 		return err
 	}
 
-	s.buf.Reset()
+	prev := s.tw
+	s.tw = tw
+	return prev.Close()
+}
+
+// mergeInto merges all runs written so far into a single section of tw.
+func (s *Sorter) mergeInto(tw *tempWriter) error {
+	iter, err := newIterator(s.tw, s.opt, s.less, s.counters)
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	iter.bestEffort = false
+	iter.onError = nil
+	iter.maxEntries = 0
+	iter.checksum = nil
+
+	run := s.numRuns - 1
+	if run < 0 {
+		run = 0
+	}
+	if err := tw.Use(s.selectCodec(run, iter.BytesRemaining())); err != nil {
+		return err
+	}
+
+	for iter.Next() {
+		if err := tw.Encode(iter.Data()); err != nil {
+			return err
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	s.counters.trackSection(tw)
 	return nil
 }
 
@@ -73,65 +674,473 @@ func (s *Sorter) flush() error {
 
 // Iterator instances are used to iterate over sorted output.
 type Iterator struct {
-	tr   *tempReader
-	heap *minHeap
+	opt     *Options
+	tr      *tempReader
+	heap    *minHeap
+	until   []byte
+	dedup   bool
+	equal   Equal
+	window  Equal
+	resolve func(a, b []byte) []byte
+	sizes   []int64
+
+	bestEffort bool
+	onError    func(int, error) SectionAction
+	failed     error
+	assert     bool
+	maxEntries int64
+	emitted    int64
+	shared     *int64 // optional emitted count, shared by split ranges
+	checksum   hash.Hash64
+	exhausted  bool
+	partial    bool // positioned after the start of the output
+
+	heartbeat *time.Ticker
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
 
 	data []byte
 	err  error
 }
 
-func newIterator(name string, offsets []int64, opt *Options) (*Iterator, error) {
-	tr, err := newTempReader(name, offsets, opt.BufferSize, opt.Compression)
+func newIterator(tw *tempWriter, opt *Options, less Less, c *counters) (*Iterator, error) {
+	tr, err := newTempReader(tw.Name(), tw.offsets, tw.codecs, opt)
 	if err != nil {
 		return nil, err
 	}
+	tr.counters = c
+	if c.metrics != nil {
+		c.metrics.ObserveMergePass(len(tw.offsets))
+	}
 
-	iter := &Iterator{tr: tr, heap: &minHeap{less: opt.Less}}
+	iter := newMergeIterator(tr, tw.sizes, opt, less)
 	for i := 0; i < tr.NumSections(); i++ {
 		if err := iter.fillHeap(i); err != nil {
 			_ = tr.Close()
 			return nil, err
 		}
 	}
+	iter.startHeartbeat(opt)
+	return iter, nil
+}
+
+// ResumeIterator creates an iterator over sorted output stored in ra,
+// starting at the position recorded by snapshot. The offsets must be the
+// ones returned by Iterator.Offsets of the iterator the snapshot was taken
+// from. The same snapshot can be resumed any number of times. Closing the
+// returned iterator does not close ra.
+func ResumeIterator(ra io.ReaderAt, offsets []int64, snapshot []byte, opt *Options) (*Iterator, error) {
+	opt = opt.norm()
+
+	codecs, sizes, pos, err := decodeSnapshot(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if len(pos) != len(offsets) {
+		return nil, ErrInvalidCursor
+	}
+
+	tr, err := openTempReader(ra, nil, offsets, codecs, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	iter := newMergeIterator(tr, sizes, opt, opt.Less)
+	if err := iter.seek(pos); err != nil {
+		_ = tr.Close()
+		return nil, err
+	}
+	iter.startHeartbeat(opt)
 	return iter, nil
 }
 
+func newMergeIterator(tr *tempReader, sizes []int64, opt *Options, less Less) *Iterator {
+	var checksum hash.Hash64
+	if opt.OutputChecksum {
+		checksum = fnv.New64a()
+	}
+
+	return &Iterator{
+		opt:        opt,
+		tr:         tr,
+		heap:       &minHeap{less: less, order: opt.MergeLess, sortKey: opt.SortKey, tieBreak: opt.TieBreak},
+		dedup:      opt.DedupScope == DedupGlobal,
+		equal:      opt.EqualWithin,
+		window:     opt.DedupWindow,
+		resolve:    opt.DedupResolve,
+		sizes:      sizes,
+		bestEffort: opt.BestEffort,
+		onError:    opt.OnSectionError,
+		assert:     opt.DebugAssertions,
+		maxEntries: opt.MaxOutputEntries,
+		checksum:   checksum,
+	}
+}
+
 // Next advances the iterator to the next item and returns true if successful.
 func (i *Iterator) Next() bool {
 	if i.err != nil {
 		return false
 	}
 	if i.heap.Len() == 0 {
+		i.exhausted = true
+		return false
+	}
+	if i.until != nil && !i.heap.less(i.heap.items[0].data, i.until) {
+		i.exhausted = true
 		return false
 	}
 
-	section, data := i.heap.PopData()
-	if err := i.fillHeap(section); err != nil {
+	_, data := i.heap.Top()
+	first, last := data, data
+	if err := i.shift(); err != nil {
 		i.err = err
 		return false
 	}
 
+	// skip duplicates from other sections
+	for i.dedup && i.heap.Len() != 0 && i.isDup(data, first, last, i.heap.items[0].data) {
+		_, next := i.heap.Top()
+		if i.resolve != nil {
+			data = i.resolve(data, next)
+		}
+		last = next
+		if err := i.shift(); err != nil {
+			i.err = err
+			return false
+		}
+	}
+
+	if i.assert && i.data != nil && i.heap.less(data, i.data) {
+		i.err = ErrOrderViolation
+		return false
+	}
+	if i.maxEntries > 0 && !i.withinLimit() {
+		i.err = ErrTooManyEntries
+		return false
+	}
+
+	if i.checksum != nil {
+		var scratch [binary.MaxVarintLen64]byte
+		_, _ = i.checksum.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(data)))])
+		_, _ = i.checksum.Write(data)
+	}
+
+	i.emitted++
 	i.data = data
 	return true
 }
 
-// Data returns the data at the current cursor position.
+// NextBatch advances the iterator by up to max items and returns them.
+// It returns an empty batch once the iterator is exhausted or if max is
+// not positive. The returned data is owned by the caller.
+func (i *Iterator) NextBatch(max int) ([][]byte, error) {
+	if max <= 0 {
+		return [][]byte{}, i.Err()
+	}
+
+	batch := make([][]byte, 0, max)
+	for len(batch) < max && i.Next() {
+		batch = append(batch, i.Data())
+	}
+	return batch, i.Err()
+}
+
+// Collect reads all remaining items into memory and closes the iterator.
+// Please use with care, the whole output must fit into memory.
+func (i *Iterator) Collect() ([][]byte, error) {
+	var res [][]byte
+	for i.Next() {
+		res = append(res, i.Data())
+	}
+	if err := i.Err(); err != nil {
+		_ = i.Close()
+		return nil, err
+	}
+	return res, i.Close()
+}
+
+// ForEach calls fn for each remaining item, until the iterator is
+// exhausted or fn returns an error, and closes the iterator.
+func (i *Iterator) ForEach(fn func(data []byte) error) error {
+	for i.Next() {
+		if err := fn(i.Data()); err != nil {
+			_ = i.Close()
+			return err
+		}
+	}
+	if err := i.Err(); err != nil {
+		_ = i.Close()
+		return err
+	}
+	return i.Close()
+}
+
+// Data returns the data at the current cursor position. The returned slice
+// is owned by the caller: it is never reused by the iterator and remains
+// valid after subsequent calls to Next and after Close.
 func (i *Iterator) Data() []byte {
 	return i.data
 }
 
 // Err returns the error, if occurred.
 func (i *Iterator) Err() error {
-	return i.err
+	if i.err != nil {
+		return i.err
+	}
+	return i.failed
+}
+
+// OutputChecksum returns a 64-bit FNV-1a hash of all items emitted by the
+// iterator, once it is exhausted. Given identical input and options, the
+// checksum does not depend on the layout of the runs, as long as the
+// output order is fully determined, i.e. Less never treats distinct items
+// as equal or TieBreakByValue is set. Otherwise, equal items may be
+// emitted in a different order and change the checksum. It requires
+// Options.OutputChecksum and returns ErrChecksumUnavailable otherwise, or
+// if the iterator was repositioned past the start of the output, e.g.
+// with ResumeFrom.
+func (i *Iterator) OutputChecksum() (uint64, error) {
+	if err := i.Err(); err != nil {
+		return 0, err
+	}
+	if i.checksum == nil || !i.exhausted || i.partial {
+		return 0, ErrChecksumUnavailable
+	}
+	return i.checksum.Sum64(), nil
+}
+
+// ActiveSections returns the number of sections (runs) which still have
+// data left to merge.
+func (i *Iterator) ActiveSections() int {
+	return i.heap.Len()
+}
+
+// BytesRemaining returns an estimate of the number of bytes left to
+// iterate over. The estimate is based on the encoded (uncompressed) size of
+// the runs, including a small per-item framing overhead, and does not
+// account for items removed by dedup.
+func (i *Iterator) BytesRemaining() int64 {
+	var n int64
+	for section, size := range i.sizes {
+		if pos := i.tr.Pos(section); pos > -1 {
+			n += size - pos
+		}
+	}
+	for _, item := range i.heap.items {
+		n += int64(encodedLen(item.data))
+	}
+	return n
+}
+
+// Progress returns an approximate completion fraction between 0 and 1,
+// derived from BytesRemaining and the total size of the runs.
+func (i *Iterator) Progress() float64 {
+	var total int64
+	for _, size := range i.sizes {
+		total += size
+	}
+	if total == 0 {
+		return 1
+	}
+
+	done := 1 - float64(i.BytesRemaining())/float64(total)
+	if done < 0 {
+		return 0
+	}
+	return done
+}
+
+// Cursor returns an opaque token which records the current position of the
+// iterator. It can be passed to ResumeFrom on any iterator over the same
+// sorted output to continue after the last item returned by Next.
+func (i *Iterator) Cursor() []byte {
+	pos := i.positions()
+
+	buf := make([]byte, 0, (len(pos)+1)*binary.MaxVarintLen64)
+	buf = appendUvarint(buf, uint64(len(pos)))
+	for _, p := range pos {
+		buf = appendVarint(buf, p)
+	}
+	return buf
+}
+
+// Snapshot captures the state of the merge, including the layout of the
+// sections. Unlike a Cursor, a snapshot can be passed to ResumeIterator to
+// create new, independent iterators from the same position.
+func (i *Iterator) Snapshot() ([]byte, error) {
+	if i.err != nil {
+		return nil, i.err
+	}
+
+	pos := i.positions()
+	buf := make([]byte, 0, (3*len(pos)+1)*binary.MaxVarintLen64)
+	buf = appendUvarint(buf, uint64(len(pos)))
+	for section, p := range pos {
+		var size int64
+		if section < len(i.sizes) {
+			size = i.sizes[section]
+		}
+		buf = appendUvarint(buf, uint64(i.tr.codecs[section]))
+		buf = appendVarint(buf, size)
+		buf = appendVarint(buf, p)
+	}
+	return buf, nil
+}
+
+// Offsets returns the end offsets of the sections in the underlying
+// temporary file.
+func (i *Iterator) Offsets() []int64 {
+	return append([]int64(nil), i.tr.offsets...)
+}
+
+// Codecs returns the compression of each section, see Offsets.
+func (i *Iterator) Codecs() []Compression {
+	return append([]Compression(nil), i.tr.codecs...)
+}
+
+// ReaderAt returns the underlying sorted sections, see Offsets. Together
+// with a Snapshot it can be used to create more iterators with
+// ResumeIterator. It must not be used after the iterator is closed.
+func (i *Iterator) ReaderAt() io.ReaderAt {
+	return i.tr.ra
+}
+
+// ResumeFrom repositions the iterator to the position recorded by cursor.
+// The next call to Next will return the item immediately following the last
+// item emitted before the cursor was taken.
+func (i *Iterator) ResumeFrom(cursor []byte) error {
+	n, sz := binary.Uvarint(cursor)
+	if sz <= 0 || int(n) != i.tr.NumSections() {
+		return ErrInvalidCursor
+	}
+	cursor = cursor[sz:]
+
+	pos := make([]int64, n)
+	for section := range pos {
+		p, sz := binary.Varint(cursor)
+		if sz <= 0 {
+			return ErrInvalidCursor
+		}
+		pos[section] = p
+		cursor = cursor[sz:]
+	}
+	if len(cursor) != 0 {
+		return ErrInvalidCursor
+	}
+
+	return i.seek(pos)
 }
 
 // Close closes the iterator.
 func (i *Iterator) Close() error {
+	i.stopHeartbeat()
 	return i.tr.Close()
 }
 
+// startHeartbeat starts the OnHeartbeat loop, if configured.
+func (i *Iterator) startHeartbeat(opt *Options) {
+	if opt.OnHeartbeat == nil {
+		return
+	}
+
+	i.heartbeat = time.NewTicker(opt.HeartbeatInterval)
+	i.done = make(chan struct{})
+	i.stopped = make(chan struct{})
+	go func(fn func()) {
+		defer close(i.stopped)
+
+		for {
+			select {
+			case <-i.done:
+				return
+			case <-i.heartbeat.C:
+				fn()
+			}
+		}
+	}(opt.OnHeartbeat)
+}
+
+// stopHeartbeat stops the OnHeartbeat loop, if running.
+func (i *Iterator) stopHeartbeat() {
+	if i.heartbeat == nil {
+		return
+	}
+
+	i.closeOnce.Do(func() {
+		i.heartbeat.Stop()
+		close(i.done)
+		<-i.stopped
+	})
+}
+
+// positions returns the position of the next item to be emitted for each
+// section, -1 for exhausted sections.
+func (i *Iterator) positions() []int64 {
+	n := i.tr.NumSections()
+	pos := make([]int64, n)
+	for section := 0; section < n; section++ {
+		pos[section] = i.tr.Pos(section)
+	}
+
+	// items buffered in the heap have been read but not yet emitted
+	for _, item := range i.heap.items {
+		pos[item.section] -= int64(encodedLen(item.data))
+	}
+	return pos
+}
+
+// seek repositions all sections and refills the heap.
+func (i *Iterator) seek(pos []int64) error {
+	i.heap.items = i.heap.items[:0]
+	i.data = nil
+	i.err = nil
+	i.failed = nil
+	i.emitted = 0
+	i.exhausted = false
+	i.partial = false
+	if i.checksum != nil {
+		i.checksum.Reset()
+	}
+
+	for section, p := range pos {
+		i.partial = i.partial || p != 0
+		if err := i.tr.Seek(section, p); err != nil {
+			i.err = err
+			return err
+		}
+		if err := i.fillHeap(section); err != nil {
+			i.err = err
+			return err
+		}
+	}
+	return nil
+}
+
+// withinLimit reports whether another item can be emitted within
+// MaxOutputEntries.
+func (i *Iterator) withinLimit() bool {
+	if i.shared != nil {
+		return atomic.AddInt64(i.shared, 1) <= i.maxEntries
+	}
+	return i.emitted < i.maxEntries
+}
+
+// isDup reports whether next duplicates the retained item data or, with
+// EqualWithin, the previously merged item last or, with DedupWindow, the
+// first item of its group.
+func (i *Iterator) isDup(data, first, last, next []byte) bool {
+	if i.equal != nil {
+		return i.equal(last, next)
+	} else if i.window != nil {
+		return i.window(first, next)
+	}
+	return !i.heap.less(data, next)
+}
+
 func (i *Iterator) fillHeap(section int) error {
-	data, err := i.tr.ReadNext(section)
+	data, err := i.readNext(section)
 	if err != nil {
 		return err
 	}
@@ -140,3 +1149,100 @@ func (i *Iterator) fillHeap(section int) error {
 	}
 	return nil
 }
+
+// shift replaces the minimum item with the next item from the same
+// section or removes it if the section is exhausted.
+func (i *Iterator) shift() error {
+	section, _ := i.heap.Top()
+	data, err := i.readNext(section)
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		i.heap.ReplaceTop(data)
+	} else {
+		i.heap.PopData()
+	}
+	return nil
+}
+
+func (i *Iterator) readNext(section int) ([]byte, error) {
+	data, err := i.tr.ReadNext(section)
+	for err != nil {
+		action := SectionAbort
+		if i.onError != nil {
+			action = i.onError(section, err)
+		} else if i.bestEffort {
+			action = SectionSkip
+		}
+
+		switch action {
+		case SectionSkip:
+			// remember the error and skip the rest of the section
+			if i.failed == nil {
+				i.failed = err
+			}
+			_ = i.tr.Seek(section, -1)
+			return nil, nil
+		case SectionRetry:
+			// re-open the section at the last good position
+			if err = i.tr.Seek(section, i.tr.pos[section]); err == nil {
+				data, err = i.tr.ReadNext(section)
+			}
+		default:
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	return append(buf, tmp[:n]...)
+}
+
+func appendVarint(buf []byte, x int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], x)
+	return append(buf, tmp[:n]...)
+}
+
+func decodeSnapshot(snapshot []byte) (codecs []Compression, sizes, pos []int64, err error) {
+	n, sz := binary.Uvarint(snapshot)
+	if sz <= 0 {
+		return nil, nil, nil, ErrInvalidCursor
+	}
+	snapshot = snapshot[sz:]
+
+	// each section is encoded in at least 3 bytes
+	if n > uint64(len(snapshot)/3) {
+		return nil, nil, nil, ErrInvalidCursor
+	}
+
+	codecs = make([]Compression, n)
+	sizes = make([]int64, n)
+	pos = make([]int64, n)
+	for section := range pos {
+		c, sz := binary.Uvarint(snapshot)
+		if sz <= 0 || c > uint64(CompressionGzip) {
+			return nil, nil, nil, ErrInvalidCursor
+		}
+		codecs[section] = Compression(c)
+		snapshot = snapshot[sz:]
+
+		if sizes[section], sz = binary.Varint(snapshot); sz <= 0 {
+			return nil, nil, nil, ErrInvalidCursor
+		}
+		snapshot = snapshot[sz:]
+
+		if pos[section], sz = binary.Varint(snapshot); sz <= 0 {
+			return nil, nil, nil, ErrInvalidCursor
+		}
+		snapshot = snapshot[sz:]
+	}
+	if len(snapshot) != 0 {
+		return nil, nil, nil, ErrInvalidCursor
+	}
+	return codecs, sizes, pos, nil
+}
@@ -3,16 +3,24 @@ package extsort_test
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/bsm/extsort"
+	"github.com/bsm/extsort/testutil"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -86,47 +94,1678 @@ var _ = Describe("Sorter", func() {
 		Expect(drain(subject)).To(Equal([]string{"bar", "baz", "dau", "foo"}))
 	})
 
+	It("should append in bulk", func() {
+		Expect(subject.AppendAll([][]byte{[]byte("foo"), []byte("bar"), []byte("baz")})).To(Succeed())
+		Expect(subject.Size()).To(Equal(int64(9)))
+		Expect(drain(subject)).To(Equal([]string{"bar", "baz", "foo"}))
+	})
+
+	It("should iterate in batches", func() {
+		Expect(subject.AppendAll([][]byte{[]byte("foo"), []byte("bar"), []byte("baz")})).To(Succeed())
+		iter, err := subject.Sort()
+		Expect(err).NotTo(HaveOccurred())
+		defer iter.Close()
+
+		Expect(iter.NextBatch(0)).To(BeEmpty())
+		Expect(iter.NextBatch(-1)).To(BeEmpty())
+		Expect(iter.NextBatch(2)).To(Equal([][]byte{[]byte("bar"), []byte("baz")}))
+		Expect(iter.NextBatch(2)).To(Equal([][]byte{[]byte("foo")}))
+		Expect(iter.NextBatch(2)).To(BeEmpty())
+	})
+
+	It("should collect data", func() {
+		Expect(subject.AppendAll([][]byte{[]byte("foo"), []byte("bar"), []byte("baz")})).To(Succeed())
+		iter, err := subject.Sort()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(iter.Next()).To(BeTrue())
+		Expect(iter.Collect()).To(Equal([][]byte{[]byte("baz"), []byte("foo")}))
+	})
+
+	It("should visit data", func() {
+		Expect(subject.AppendAll([][]byte{[]byte("foo"), []byte("bar"), []byte("baz")})).To(Succeed())
+		iter, err := subject.Sort()
+		Expect(err).NotTo(HaveOccurred())
+
+		var seen []string
+		stop := errors.New("stop")
+		Expect(iter.ForEach(func(data []byte) error {
+			seen = append(seen, string(data))
+			if len(seen) == 2 {
+				return stop
+			}
+			return nil
+		})).To(Equal(stop))
+		Expect(seen).To(Equal([]string{"bar", "baz"}))
+	})
+
 	It("should support compression", func() {
 		compressed := extsort.New(&extsort.Options{
 			BufferSize:  1024 * 1024,
 			WorkDir:     workDir,
 			Compression: extsort.CompressionGzip,
-		})
-		defer compressed.Close()
+		})
+		defer compressed.Close()
+
+		Expect(compressed.Append([]byte("foo"))).To(Succeed())
+		Expect(compressed.Append([]byte("bar"))).To(Succeed())
+		Expect(compressed.Append([]byte("baz"))).To(Succeed())
+		Expect(compressed.Append([]byte("dau"))).To(Succeed())
+		Expect(drain(compressed)).To(Equal([]string{"bar", "baz", "dau", "foo"}))
+	})
+
+	It("should compress temporary files", func() {
+		compressed := extsort.New(&extsort.Options{
+			BufferSize:  1024 * 1024,
+			WorkDir:     workDir,
+			Compression: extsort.CompressionGzip,
+		})
+		defer compressed.Close()
+
+		for i := 0; i < 200; i++ {
+			Expect(compressed.Append([]byte("foo"))).To(Succeed())
+		}
+		Expect(drain(compressed)).To(HaveLen(200))
+		Expect(fileSize()).To(BeNumerically("~", 50, 5))
+	})
+
+	It("should report compression ratios", func() {
+		Expect(subject.Stats().CompressionRatio).To(BeZero())
+		Expect(subject.Append([]byte("foo"))).To(Succeed())
+		Expect(drain(subject)).To(HaveLen(1))
+		Expect(subject.Stats().CompressionRatio).To(Equal(1.0))
+
+		compressed := extsort.New(&extsort.Options{
+			BufferSize:  1024 * 1024,
+			WorkDir:     workDir,
+			Compression: extsort.CompressionGzip,
+		})
+		defer compressed.Close()
+
+		for i := 0; i < 200; i++ {
+			Expect(compressed.Append([]byte("foo"))).To(Succeed())
+		}
+		Expect(drain(compressed)).To(HaveLen(200))
+		Expect(compressed.Stats().CompressionRatio).To(BeNumerically(">", 10))
+	})
+
+	It("should select codecs per run", func() {
+		var runs []int
+		sorter := extsort.New(&extsort.Options{
+			BufferSize: 64 * 1024,
+			WorkDir:    workDir,
+			SelectCodec: func(run int) extsort.Compression {
+				runs = append(runs, run)
+				if run%2 == 0 {
+					return extsort.CompressionGzip
+				}
+				return extsort.CompressionNone
+			},
+		})
+		defer sorter.Close()
+
+		Expect(appendShuffled(sorter, 20000, 20000)).To(Succeed())
+		res, err := drain(sorter)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(HaveLen(20000))
+		Expect(sort.StringsAreSorted(res)).To(BeTrue())
+		Expect(runs).To(Equal([]int{0, 1, 2}))
+		Expect(sorter.Stats().CompressionRatio).To(BeNumerically(">", 1.2))
+	})
+
+	It("should emit metrics", func() {
+		metrics := new(testMetrics)
+		sorter := extsort.New(&extsort.Options{
+			BufferSize: 64 * 1024,
+			WorkDir:    workDir,
+			Metrics:    metrics,
+		})
+		defer sorter.Close()
+
+		Expect(appendShuffled(sorter, 20000, 20000)).To(Succeed())
+		Expect(drain(sorter)).To(HaveLen(20000))
+		Expect(metrics.runs).To(Equal(int64(3)))
+		Expect(metrics.written).To(Equal(int64(20000 * 9)))
+		Expect(metrics.passes).To(Equal([]int{3}))
+	})
+
+	It("should count reads", func() {
+		Expect(subject.Stats().Reads).To(BeZero())
+		for i := 0; i < 20000; i++ {
+			Expect(subject.Append([]byte(fmt.Sprintf("%08d", i)))).To(Succeed())
+		}
+		Expect(drain(subject)).To(HaveLen(20000))
+
+		stats := subject.Stats()
+		Expect(stats.Reads).To(Equal(int64(20000)))
+		Expect(stats.BytesRead).To(Equal(int64(20000 * 9)))
+	})
+
+	It("should only compress runs above a threshold", func() {
+		compressed := extsort.New(&extsort.Options{
+			BufferSize:       1024 * 1024,
+			WorkDir:          workDir,
+			Compression:      extsort.CompressionGzip,
+			CompressMinBytes: 1024,
+		})
+		defer compressed.Close()
+
+		for i := 0; i < 200; i++ {
+			Expect(compressed.Append([]byte("foo"))).To(Succeed())
+		}
+		Expect(drain(compressed)).To(HaveLen(200))
+		Expect(fileSize()).To(Equal(int64(800)))
+	})
+
+	It("should read runs with mixed compression", func() {
+		compressed := extsort.New(&extsort.Options{
+			BufferSize:       64 * 1024,
+			WorkDir:          workDir,
+			Compression:      extsort.CompressionGzip,
+			CompressMinBytes: 50000,
+		})
+		defer compressed.Close()
+
+		Expect(appendShuffled(compressed, 20000, 20000)).To(Succeed())
+		res, err := drain(compressed)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(HaveLen(20000))
+		Expect(sort.StringsAreSorted(res)).To(BeTrue())
+	})
+
+	It("should support compression levels", func() {
+		sizes := make([]int64, 0, 2)
+		for _, level := range []int{gzip.HuffmanOnly, gzip.BestCompression} {
+			compressed := extsort.New(&extsort.Options{
+				BufferSize:       1024 * 1024,
+				WorkDir:          workDir,
+				Compression:      extsort.CompressionGzip,
+				CompressionLevel: level,
+			})
+			for i := 0; i < 2000; i++ {
+				Expect(compressed.Append([]byte(fmt.Sprintf("%04d", i%50)))).To(Succeed())
+			}
+			Expect(drain(compressed)).To(HaveLen(2000))
+
+			size, err := fileSize()
+			Expect(err).NotTo(HaveOccurred())
+			sizes = append(sizes, size)
+			Expect(compressed.Close()).To(Succeed())
+		}
+		Expect(sizes[1]).To(BeNumerically("<", sizes[0]))
+
+		invalid := extsort.New(&extsort.Options{WorkDir: workDir, Compression: extsort.CompressionGzip, CompressionLevel: 42})
+		defer invalid.Close()
+		Expect(invalid.Append([]byte("foo"))).To(MatchError("extsort: invalid compression level 42"))
+		Expect(invalid.Options().CompressionLevel).To(Equal(42))
+
+		tempDir := extsort.New(&extsort.Options{Compression: extsort.CompressionGzip, CompressionLevel: 42})
+		defer tempDir.Close()
+		Expect(tempDir.Append([]byte("foo"))).To(MatchError("extsort: invalid compression level 42"))
+		Expect(tempDir.Append([]byte("bar"))).To(MatchError("extsort: invalid compression level 42"))
+	})
+
+	It("should copy values", func() {
+		var val []byte
+		Expect(subject.Append(append(val[:0], "foo"...))).To(Succeed())
+		Expect(subject.Append(append(val[:0], "bar"...))).To(Succeed())
+		Expect(subject.Append(append(val[:0], "baz"...))).To(Succeed())
+		Expect(subject.Append(append(val[:0], "dau"...))).To(Succeed())
+		Expect(drain(subject)).To(Equal([]string{"bar", "baz", "dau", "foo"}))
+	})
+
+	It("should optionally reject empty data", func() {
+		Expect(subject.Append(nil)).To(Succeed())
+
+		sorter := extsort.New(&extsort.Options{WorkDir: workDir, RejectEmpty: true})
+		defer sorter.Close()
+
+		Expect(sorter.Append(nil)).To(MatchError(extsort.ErrEmptyData))
+		Expect(sorter.Append([]byte{})).To(MatchError(extsort.ErrEmptyData))
+		Expect(sorter.Append([]byte("foo"))).To(Succeed())
+		Expect(drain(sorter)).To(Equal([]string{"foo"}))
+	})
+
+	It("should optionally limit the data size", func() {
+		Expect(subject.Append([]byte("foobar"))).To(Succeed())
+
+		strict := extsort.New(&extsort.Options{WorkDir: workDir, MaxDataSize: 3})
+		defer strict.Close()
+
+		Expect(strict.Append([]byte("foobar"))).To(MatchError(extsort.ErrDataTooLarge))
+		Expect(strict.Append([]byte("bar"))).To(Succeed())
+		Expect(drain(strict)).To(Equal([]string{"bar"}))
+
+		truncating := extsort.New(&extsort.Options{WorkDir: workDir, MaxDataSize: 3, TruncateData: true})
+		defer truncating.Close()
+
+		Expect(truncating.Append([]byte("foobar"))).To(Succeed())
+		Expect(truncating.Append([]byte("ba"))).To(Succeed())
+		Expect(drain(truncating)).To(Equal([]string{"ba", "foo"}))
+	})
+
+	It("should optionally enforce a memory limit", func() {
+		Expect(subject.CanFit(make([]byte, 1<<24))).To(BeTrue())
+
+		sorter := extsort.New(&extsort.Options{WorkDir: workDir, MemoryLimit: 4, StrictMemory: true})
+		defer sorter.Close()
+
+		Expect(sorter.CanFit([]byte("foobar"))).To(BeFalse())
+		Expect(sorter.CanFit([]byte("foo"))).To(BeTrue())
+		Expect(sorter.Append([]byte("foobar"))).To(MatchError(extsort.ErrMemoryLimit))
+		Expect(sorter.Append([]byte("foo"))).To(Succeed())
+		Expect(drain(sorter)).To(Equal([]string{"foo"}))
+
+		// the buffer is flushed before it exceeds the limit
+		sorter = extsort.New(&extsort.Options{WorkDir: workDir, MemoryLimit: 4, StrictMemory: true, SpillThreshold: 1 << 20})
+		defer sorter.Close()
+
+		for i := 0; i < 100; i++ {
+			Expect(sorter.Append([]byte("foo"))).To(Succeed())
+		}
+		Expect(sorter.RunSizes()).To(HaveLen(99))
+		Expect(drain(sorter)).To(HaveLen(100))
+
+		// AsyncFlush splits the limit between both buffers
+		sorter = extsort.New(&extsort.Options{WorkDir: workDir, MemoryLimit: 8, StrictMemory: true, AsyncFlush: true})
+		defer sorter.Close()
+
+		Expect(sorter.CanFit([]byte("foobar"))).To(BeFalse())
+		for i := 0; i < 100; i++ {
+			Expect(sorter.Append([]byte("foo"))).To(Succeed())
+		}
+		Expect(drain(sorter)).To(HaveLen(100))
+		Expect(sorter.RunSizes()).To(HaveLen(100))
+	})
+
+	It("should check the work dir", func() {
+		dir := filepath.Join(workDir, "sub", "dir")
+
+		missing := extsort.New(&extsort.Options{WorkDir: dir})
+		defer missing.Close()
+		Expect(missing.Append([]byte("foo"))).To(MatchError("extsort: work dir " + dir + " does not exist"))
+		_, err := missing.Sort()
+		Expect(err).To(MatchError("extsort: work dir " + dir + " does not exist"))
+
+		created := extsort.New(&extsort.Options{WorkDir: dir, CreateWorkDir: true})
+		defer created.Close()
+		Expect(created.Append([]byte("foo"))).To(Succeed())
+		Expect(drain(created)).To(Equal([]string{"foo"}))
+		Expect(filepath.Glob(dir + "/*")).To(HaveLen(1))
+		Expect(created.Close()).To(Succeed())
+		Expect(os.RemoveAll(filepath.Join(workDir, "sub"))).To(Succeed())
+	})
+
+	It("should name and clean up temporary files", func() {
+		sorter := extsort.New(&extsort.Options{WorkDir: workDir})
+		Expect(sorter.Append([]byte("foo"))).To(Succeed())
+		Expect(drain(sorter)).To(HaveLen(1))
+		Expect(filepath.Glob(workDir + "/extsort*.extsort")).To(HaveLen(1))
+		Expect(sorter.Close()).To(Succeed())
+
+		for _, name := range []string{"extsort123.extsort", "extsort.extsort", "extsortabc.extsort", "extsort123.txt", "other.extsort"} {
+			Expect(ioutil.WriteFile(filepath.Join(workDir, name), nil, 0600)).To(Succeed())
+		}
+		Expect(extsort.CleanupWorkDir(workDir, "", time.Hour)).To(Succeed())
+		Expect(filepath.Glob(workDir + "/*")).To(HaveLen(5))
+
+		past := time.Now().Add(-2 * time.Hour)
+		Expect(os.Chtimes(filepath.Join(workDir, "extsort123.extsort"), past, past)).To(Succeed())
+		Expect(extsort.CleanupWorkDir(workDir, "", time.Hour)).To(Succeed())
+
+		entries, err := filepath.Glob(workDir + "/*")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(ConsistOf(
+			filepath.Join(workDir, "extsort.extsort"),
+			filepath.Join(workDir, "extsortabc.extsort"),
+			filepath.Join(workDir, "extsort123.txt"),
+			filepath.Join(workDir, "other.extsort"),
+		))
+
+		Expect(ioutil.WriteFile(filepath.Join(workDir, "extsort456.tmp"), nil, 0600)).To(Succeed())
+		Expect(extsort.CleanupWorkDir(workDir, ".tmp", 0)).To(Succeed())
+		Expect(filepath.Glob(workDir + "/*")).To(Equal(entries))
+
+		for _, name := range entries {
+			Expect(os.Remove(name)).To(Succeed())
+		}
+	})
+
+	It("should support custom temporary files", func() {
+		var opened []string
+		sorter := extsort.New(&extsort.Options{
+			WorkDir: workDir,
+			OpenTempFile: func(dir string) (*os.File, error) {
+				name := filepath.Join(dir, fmt.Sprintf("custom-%d", len(opened)))
+				opened = append(opened, name)
+				return os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+			},
+		})
+		defer sorter.Close()
+
+		Expect(sorter.Append([]byte("foo"))).To(Succeed())
+		Expect(drain(sorter)).To(Equal([]string{"foo"}))
+		Expect(opened).To(Equal([]string{filepath.Join(workDir, "custom-0")}))
+		Expect(filepath.Glob(workDir + "/*")).To(Equal(opened))
+	})
+
+	It("should not fail when blank", func() {
+		Expect(drain(subject)).To(BeEmpty())
+		Expect(subject.Spilled()).To(BeFalse())
+	})
+
+	It("should sort lexically by default", func() {
+		sorter := extsort.New(&extsort.Options{WorkDir: workDir})
+		defer sorter.Close()
+
+		rnd := rand.New(rand.NewSource(1))
+		expected := make([]string, 0, 1000)
+		for i := 0; i < 1000; i++ {
+			data := make([]byte, 1+rnd.Intn(8))
+			rnd.Read(data)
+			Expect(sorter.Append(data)).To(Succeed())
+			expected = append(expected, string(data))
+		}
+		sort.Slice(expected, func(i, j int) bool {
+			return bytes.Compare([]byte(expected[i]), []byte(expected[j])) < 0
+		})
+		Expect(drain(sorter)).To(Equal(expected))
+	})
+
+	It("should report run sizes", func() {
+		sorter := extsort.New(&extsort.Options{BufferSize: 64 * 1024, WorkDir: workDir})
+		defer sorter.Close()
+
+		for i := 0; i < 20000; i++ {
+			Expect(sorter.Append([]byte(fmt.Sprintf("%08d", i)))).To(Succeed())
+		}
+		Expect(sorter.RunSizes()).To(Equal([]int64{8192, 8192}))
+		Expect(sorter.Spilled()).To(BeTrue())
+
+		iter, err := sorter.Sort()
+		Expect(err).NotTo(HaveOccurred())
+		defer iter.Close()
+		Expect(sorter.RunSizes()).To(Equal([]int64{8192, 8192, 3616}))
+
+		Expect(iter.ActiveSections()).To(Equal(3))
+		Expect(iter.BytesRemaining()).To(Equal(int64(20000 * 9)))
+		Expect(iter.Progress()).To(BeZero())
+		for n := 20000; iter.Next(); n-- {
+			Expect(iter.BytesRemaining()).To(Equal(int64(n-1) * 9))
+			if n == 10000 {
+				Expect(iter.Progress()).To(BeNumerically("~", 0.5, 0.001))
+			}
+		}
+		Expect(iter.Err()).NotTo(HaveOccurred())
+		Expect(iter.ActiveSections()).To(Equal(0))
+		Expect(iter.BytesRemaining()).To(BeZero())
+		Expect(iter.Progress()).To(Equal(1.0))
+	})
+
+	It("should support custom sort functions", func() {
+		var calls int
+		sorter := extsort.New(&extsort.Options{
+			BufferSize: 64 * 1024,
+			WorkDir:    workDir,
+			Less:       func(a, b []byte) bool { return a[0] < b[0] },
+			Sort: func(data sort.Interface) {
+				calls++
+				extsort.DefaultSort(data)
+
+				// reverse each group of equal items
+				for i, n := 0, data.Len(); i < n; {
+					j := i + 1
+					for j < n && !data.Less(i, j) {
+						j++
+					}
+					for x, y := i, j-1; x < y; x, y = x+1, y-1 {
+						data.Swap(x, y)
+					}
+					i = j
+				}
+			},
+		})
+		defer sorter.Close()
+
+		for i := 0; i < 20000; i++ {
+			Expect(sorter.Append([]byte(fmt.Sprintf("%c%08d", 'a'+i%7, i)))).To(Succeed())
+		}
+		res, err := drain(sorter)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(calls).To(Equal(3))
+		Expect(res).To(HaveLen(20000))
+		for i := 1; i < len(res); i++ {
+			Expect(res[i-1][0]).To(BeNumerically("<=", res[i][0]))
+		}
+	})
+
+	It("should optionally detect order violations", func() {
+		sorter := extsort.New(&extsort.Options{
+			WorkDir:         workDir,
+			Sort:            func(sort.Interface) {},
+			DebugAssertions: true,
+		})
+		defer sorter.Close()
+
+		Expect(sorter.Append([]byte("foo"))).To(Succeed())
+		Expect(sorter.Append([]byte("bar"))).To(Succeed())
+		_, err := drain(sorter)
+		Expect(err).To(MatchError(extsort.ErrOrderViolation))
+	})
+
+	It("should produce reproducible output", func() {
+		run := func() []string {
+			sorter := extsort.New(&extsort.Options{
+				BufferSize: 64 * 1024,
+				WorkDir:    workDir,
+				Less:       func(a, b []byte) bool { return a[0] < b[0] },
+			})
+			defer sorter.Close()
+
+			for i := 0; i < 20000; i++ {
+				Expect(sorter.Append([]byte(fmt.Sprintf("%c%08d", 'a'+i%7, i)))).To(Succeed())
+			}
+			res, err := drain(sorter)
+			Expect(err).NotTo(HaveOccurred())
+			return res
+		}
+
+		res := run()
+		Expect(res).To(HaveLen(20000))
+		Expect(run()).To(Equal(res))
+	})
+
+	It("should estimate frequencies", func() {
+		Expect(subject.Append([]byte("foo"))).To(Succeed())
+		Expect(subject.Frequency([]byte("foo"))).To(BeZero())
+
+		sorter := extsort.New(&extsort.Options{WorkDir: workDir, FrequencySketch: true})
+		defer sorter.Close()
+
+		for i := 0; i < 10000; i++ {
+			Expect(sorter.Append([]byte(fmt.Sprintf("%d", i%1000)))).To(Succeed())
+		}
+		Expect(sorter.Append([]byte("hot"))).To(Succeed())
+		Expect(sorter.Append([]byte("hot"))).To(Succeed())
+
+		Expect(sorter.Frequency([]byte("hot"))).To(BeNumerically(">=", 2))
+		Expect(sorter.Frequency([]byte("42"))).To(BeNumerically(">=", 10))
+		Expect(sorter.Frequency([]byte("42"))).To(BeNumerically("<", 20))
+	})
+
+	It("should support custom growth factors", func() {
+		sorter := extsort.New(&extsort.Options{BufferSize: 64 * 1024, WorkDir: workDir, GrowthFactor: 1.1})
+		defer sorter.Close()
+
+		Expect(appendShuffled(sorter, 20000, 20000)).To(Succeed())
+		res, err := drain(sorter)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(HaveLen(20000))
+		Expect(sort.StringsAreSorted(res)).To(BeTrue())
+	})
+
+	It("should flush asynchronously", func() {
+		sorter := extsort.New(&extsort.Options{BufferSize: 64 * 1024, WorkDir: workDir, AsyncFlush: true})
+		defer sorter.Close()
+
+		Expect(appendShuffled(sorter, 20000, 20000)).To(Succeed())
+
+		res, err := drain(sorter)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(HaveLen(20000))
+		Expect(sort.StringsAreSorted(res)).To(BeTrue())
+		Expect(sorter.RunSizes()).To(Equal([]int64{8192, 8192, 3616}))
+	})
+
+	It("should split the merge memory budget", func() {
+		sorter := extsort.New(&extsort.Options{BufferSize: 64 * 1024, WorkDir: workDir, MergeMemoryBudget: 16 * 1024})
+		defer sorter.Close()
+
+		Expect(appendShuffled(sorter, 20000, 20000)).To(Succeed())
+		Expect(sorter.RunSizes()).To(Equal([]int64{8192, 8192}))
+
+		res, err := drain(sorter)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(HaveLen(20000))
+		Expect(sort.StringsAreSorted(res)).To(BeTrue())
+	})
+
+	It("should expose flushed runs", func() {
+		var runs [][]string
+		sorter := extsort.New(&extsort.Options{
+			BufferSize: 64 * 1024,
+			WorkDir:    workDir,
+			OnRunFlushed: func(index int, r io.ReaderAt, offsets []int64, codecs []extsort.Compression) error {
+				Expect(index).To(Equal(len(runs)))
+				Expect(offsets).To(HaveLen(index + 1))
+				Expect(codecs).To(HaveLen(index + 1))
+
+				start := int64(0)
+				if index > 0 {
+					start = offsets[index-1]
+				}
+				sr := bufio.NewReader(io.NewSectionReader(r, start, offsets[index]-start))
+
+				var run []string
+				for {
+					data, err := extsort.DecodeEntry(sr)
+					if err == io.EOF {
+						break
+					}
+					Expect(err).NotTo(HaveOccurred())
+					run = append(run, string(data))
+				}
+				runs = append(runs, run)
+				return nil
+			},
+		})
+		defer sorter.Close()
+
+		Expect(appendShuffled(sorter, 20000, 20000)).To(Succeed())
+		Expect(drain(sorter)).To(HaveLen(20000))
+		Expect(runs).To(HaveLen(3))
+		for i, run := range runs {
+			Expect(int64(len(run))).To(Equal(sorter.RunSizes()[i]))
+			Expect(sort.StringsAreSorted(run)).To(BeTrue())
+		}
+
+		failing := extsort.New(&extsort.Options{
+			WorkDir:      workDir,
+			OnRunFlushed: func(int, io.ReaderAt, []int64, []extsort.Compression) error { return errors.New("failed") },
+		})
+		defer failing.Close()
+
+		Expect(failing.Append([]byte("foo"))).To(Succeed())
+		_, err := failing.Sort()
+		Expect(err).To(MatchError("failed"))
+	})
+
+	It("should expose the codecs of flushed runs", func() {
+		var runs [][]string
+		sorter := extsort.New(&extsort.Options{
+			BufferSize: 64 * 1024,
+			WorkDir:    workDir,
+			SelectCodec: func(run int) extsort.Compression {
+				if run%2 == 0 {
+					return extsort.CompressionGzip
+				}
+				return extsort.CompressionNone
+			},
+			OnRunFlushed: func(index int, r io.ReaderAt, offsets []int64, codecs []extsort.Compression) error {
+				start := int64(0)
+				if index > 0 {
+					start = offsets[index-1]
+				}
+
+				var sr io.Reader = io.NewSectionReader(r, start, offsets[index]-start)
+				if codecs[index] == extsort.CompressionGzip {
+					zr, err := gzip.NewReader(sr)
+					if err != nil {
+						return err
+					}
+					defer zr.Close()
+					sr = zr
+				}
+
+				var run []string
+				for br := bufio.NewReader(sr); ; {
+					data, err := extsort.DecodeEntry(br)
+					if err == io.EOF {
+						break
+					} else if err != nil {
+						return err
+					}
+					run = append(run, string(data))
+				}
+				runs = append(runs, run)
+				return nil
+			},
+		})
+		defer sorter.Close()
+
+		Expect(appendShuffled(sorter, 20000, 20000)).To(Succeed())
+		iter, err := sorter.Sort()
+		Expect(err).NotTo(HaveOccurred())
+		defer iter.Close()
+
+		Expect(iter.Codecs()).To(Equal([]extsort.Compression{extsort.CompressionGzip, extsort.CompressionNone, extsort.CompressionGzip}))
+		Expect(runs).To(HaveLen(3))
+		for i, run := range runs {
+			Expect(int64(len(run))).To(Equal(sorter.RunSizes()[i]))
+			Expect(sort.StringsAreSorted(run)).To(BeTrue())
+		}
+	})
+
+	It("should save and load state", func() {
+		sorter := extsort.New(&extsort.Options{BufferSize: 64 * 1024, WorkDir: workDir, Compression: extsort.CompressionGzip})
+		defer sorter.Close()
+
+		Expect(appendShuffled(sorter, 20000, 20000)).To(Succeed())
+		Expect(sorter.RunSizes()).To(Equal([]int64{8192, 8192}))
+
+		state := new(bytes.Buffer)
+		Expect(sorter.SaveState(state)).To(Succeed())
+
+		loaded, err := extsort.LoadState(bytes.NewReader(state.Bytes()), &extsort.Options{BufferSize: 64 * 1024, WorkDir: workDir})
+		Expect(err).NotTo(HaveOccurred())
+		defer loaded.Close()
+
+		Expect(loaded.RunSizes()).To(Equal(sorter.RunSizes()))
+		Expect(loaded.Size()).To(Equal(sorter.Size()))
+		Expect(loaded.Spilled()).To(BeTrue())
+
+		expected, err := drain(sorter)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(expected).To(HaveLen(20000))
+		Expect(drain(loaded)).To(Equal(expected))
+
+		_, err = extsort.LoadState(bytes.NewReader([]byte("bad")), &extsort.Options{WorkDir: workDir})
+		Expect(err).To(MatchError(extsort.ErrInvalidState))
+		_, err = extsort.LoadState(bytes.NewReader(state.Bytes()[:state.Len()/2]), &extsort.Options{WorkDir: workDir})
+		Expect(err).To(MatchError(extsort.ErrInvalidState))
+		_, err = extsort.LoadState(bytes.NewReader(state.Bytes()[:state.Len()-3]), &extsort.Options{WorkDir: workDir})
+		Expect(err).To(MatchError(extsort.ErrInvalidState))
+
+		// oversized entry and run counts
+		for _, corrupt := range []string{
+			"extsort\x01\x00\x01\x01\x01\x01\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01",
+			"extsort\x01\x00\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01",
+			"extsort\x01\x00\x00\x01",
+		} {
+			_, err = extsort.LoadState(bytes.NewReader([]byte(corrupt)), &extsort.Options{WorkDir: workDir})
+			Expect(err).To(MatchError(extsort.ErrInvalidState))
+		}
+	})
+
+	It("should merge runs eagerly", func() {
+		sorter := extsort.New(&extsort.Options{BufferSize: 64 * 1024, WorkDir: workDir, MergeWhenRuns: 2})
+		defer sorter.Close()
+
+		Expect(appendShuffled(sorter, 50000, 50000)).To(Succeed())
+		Expect(sorter.RunSizes()).To(HaveLen(6))
+		Expect(filepath.Glob(workDir + "/*")).To(HaveLen(1))
+
+		iter, err := sorter.Sort()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(iter.ActiveSections()).To(Equal(1))
+
+		res, err := iter.Collect()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(HaveLen(50000))
+		for i, data := range res {
+			Expect(string(data)).To(Equal(fmt.Sprintf("%08d", i)))
+		}
+
+		selected := extsort.New(&extsort.Options{
+			BufferSize:    64 * 1024,
+			WorkDir:       workDir,
+			MergeWhenRuns: 2,
+			Compression:   extsort.CompressionGzip,
+			SelectCodec:   func(int) extsort.Compression { return extsort.CompressionNone },
+		})
+		defer selected.Close()
+
+		Expect(appendShuffled(selected, 50000, 50000)).To(Succeed())
+		iter, err = selected.Sort()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(iter.Codecs()).To(Equal([]extsort.Compression{extsort.CompressionNone}))
+		defer iter.Close()
+		Expect(iter.Collect()).To(HaveLen(50000))
+	})
+
+	It("should resolve duplicates", func() {
+		sorter := extsort.New(&extsort.Options{
+			BufferSize: 64 * 1024,
+			WorkDir:    workDir,
+			DedupScope: extsort.DedupGlobal,
+			Less:       func(a, b []byte) bool { return bytes.Compare(a[:4], b[:4]) < 0 },
+			DedupResolve: func(a, b []byte) []byte {
+				if bytes.Compare(a, b) < 0 {
+					return b
+				}
+				return a
+			},
+		})
+		defer sorter.Close()
+
+		// 1000 keys, 20 versions each, spread across runs
+		for i := 0; i < 20000; i++ {
+			n := (i * 7919) % 20000
+			Expect(sorter.Append([]byte(fmt.Sprintf("%04d%04d", n%1000, n/1000)))).To(Succeed())
+		}
+		res, err := drain(sorter)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(HaveLen(1000))
+		for i, data := range res {
+			Expect(data).To(Equal(fmt.Sprintf("%04d0019", i)))
+		}
+	})
+
+	It("should dedup within a tolerance", func() {
+		sorter := extsort.New(&extsort.Options{
+			BufferSize: 64 * 1024,
+			WorkDir:    workDir,
+			DedupScope: extsort.DedupGlobal,
+			EqualWithin: func(a, b []byte) bool {
+				x, _ := strconv.Atoi(string(a))
+				y, _ := strconv.Atoi(string(b))
+				return y-x <= 2 && x-y <= 2
+			},
+		})
+		defer sorter.Close()
+
+		// 5000 keys, each with 3 near-equal variants, spread across runs
+		for i := 0; i < 15000; i++ {
+			n := (i * 7919) % 15000
+			Expect(sorter.Append([]byte(fmt.Sprintf("%08d", (n%5000)*10+n/5000)))).To(Succeed())
+		}
+		res, err := drain(sorter)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(HaveLen(5000))
+		for i, data := range res {
+			Expect(data).To(Equal(fmt.Sprintf("%08d", i*10)))
+		}
+	})
+
+	It("should sort by derived keys", func() {
+		var calls int
+		sorter := extsort.New(&extsort.Options{
+			BufferSize: 64 * 1024,
+			WorkDir:    workDir,
+			SortKey: func(data []byte) []byte {
+				calls++
+				n, _ := strconv.Atoi(string(data[bytes.IndexByte(data, ':')+1:]))
+				return []byte(fmt.Sprintf("%08d", n))
+			},
+		})
+		defer sorter.Close()
+
+		for i := 0; i < 20000; i++ {
+			n := (i * 7919) % 20000
+			Expect(sorter.Append([]byte(fmt.Sprintf("k%d:%d", n%7, n)))).To(Succeed())
+		}
+		res, err := drain(sorter)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(HaveLen(20000))
+		for i, s := range res {
+			Expect(s).To(Equal(fmt.Sprintf("k%d:%d", i%7, i)))
+		}
+		Expect(sorter.RunSizes()).To(HaveLen(3))
+		Expect(calls).To(Equal(2 * 20000))
+	})
+
+	It("should break ties", func() {
+		run := func(tieBreak extsort.TieBreak) []string {
+			sorter := extsort.New(&extsort.Options{
+				BufferSize: 64 * 1024,
+				WorkDir:    workDir,
+				Less:       func(a, b []byte) bool { return bytes.Compare(a[:4], b[:4]) < 0 },
+				TieBreak:   tieBreak,
+			})
+			defer sorter.Close()
+
+			// 1000 keys, 20 versions each, spread across runs
+			for i := 0; i < 20000; i++ {
+				n := (i * 7919) % 20000
+				Expect(sorter.Append([]byte(fmt.Sprintf("%04d%04d", n%1000, n/1000)))).To(Succeed())
+			}
+			res, err := drain(sorter)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(HaveLen(20000))
+			return res
+		}
+
+		Expect(sort.StringsAreSorted(run(extsort.TieBreakByValue))).To(BeTrue())
+
+		// equal keys retain the append order
+		expected := make(map[string][]string)
+		for i := 0; i < 20000; i++ {
+			n := (i * 7919) % 20000
+			key := fmt.Sprintf("%04d", n%1000)
+			expected[key] = append(expected[key], fmt.Sprintf("%04d", n/1000))
+		}
+
+		actual := make(map[string][]string)
+		for _, s := range run(extsort.TieBreakBySection) {
+			actual[s[:4]] = append(actual[s[:4]], s[4:])
+		}
+		Expect(actual).To(Equal(expected))
+	})
+
+	It("should merge with a custom order", func() {
+		sorter := extsort.New(&extsort.Options{
+			BufferSize:       64 * 1024,
+			WorkDir:          workDir,
+			TargetRunEntries: 1000,
+			DedupScope:       extsort.DedupGlobal,
+			Less:             func(a, b []byte) bool { return bytes.Compare(a[:4], b[:4]) < 0 },
+			MergeLess: func(a, b []byte) bool {
+				if c := bytes.Compare(a[:4], b[:4]); c != 0 {
+					return c < 0
+				}
+				return a[4] > b[4] // highest score first
+			},
+		})
+		defer sorter.Close()
+
+		// 1000 keys in 3 runs, each with a different score per run
+		for run := 0; run < 3; run++ {
+			for i := 0; i < 1000; i++ {
+				Expect(sorter.Append([]byte(fmt.Sprintf("%04d%d", i, (i+run*3)%10)))).To(Succeed())
+			}
+		}
+
+		res, err := drain(sorter)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sorter.RunSizes()).To(Equal([]int64{1000, 1000, 1000}))
+		Expect(res).To(HaveLen(1000))
+		Expect(res[:4]).To(Equal([]string{"00006", "00017", "00028", "00039"}))
+	})
+
+	It("should interleave equal items round-robin", func() {
+		sorter := extsort.New(&extsort.Options{
+			BufferSize: 64 * 1024,
+			WorkDir:    workDir,
+			Less:       func(a, b []byte) bool { return bytes.Compare(a[:4], b[:4]) < 0 },
+			TieBreak:   extsort.TieBreakRoundRobin,
+		})
+		defer sorter.Close()
+
+		// 4 runs with 10 keys each, keys in run N have N+1 versions
+		for run := 0; run < 4; run++ {
+			for i := 0; i < (run+1)*10; i++ {
+				Expect(sorter.Append([]byte(fmt.Sprintf("%04d%d%02d", i%10, run, i/10)))).To(Succeed())
+			}
+			Expect(sorter.Append(bytes.Repeat([]byte{'z'}, 64*1024))).To(Succeed())
+		}
+
+		res, err := drain(sorter)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(HaveLen(104))
+		Expect(res[:10]).To(Equal([]string{
+			"0000000", "0000100", "0000200", "0000300",
+			"0000101", "0000201", "0000301",
+			"0000202", "0000302",
+			"0000303",
+		}))
+	})
+
+	It("should dedup within a window", func() {
+		within := func(a, b []byte) bool {
+			x, _ := strconv.Atoi(string(a))
+			y, _ := strconv.Atoi(string(b))
+			return y-x < 5
+		}
+		run := func(opt *extsort.Options) []string {
+			opt.BufferSize = 64 * 1024
+			opt.WorkDir = workDir
+			opt.DedupScope = extsort.DedupGlobal
+
+			sorter := extsort.New(opt)
+			defer sorter.Close()
+
+			// three runs, each containing [00000000, 00000999] several times
+			for i := 0; i < 20000; i++ {
+				Expect(sorter.Append([]byte(fmt.Sprintf("%08d", i%1000)))).To(Succeed())
+			}
+			res, err := drain(sorter)
+			Expect(err).NotTo(HaveOccurred())
+			return res
+		}
+
+		res := run(&extsort.Options{DedupWindow: within})
+		Expect(res).To(HaveLen(200))
+		for i, s := range res {
+			Expect(s).To(Equal(fmt.Sprintf("%08d", i*5)))
+		}
+
+		// adjacent pairs are chained
+		Expect(run(&extsort.Options{EqualWithin: within})).To(Equal([]string{"00000000"}))
+	})
+
+	It("should return unique data", func() {
+		sorter := extsort.New(&extsort.Options{BufferSize: 64 * 1024, WorkDir: workDir})
+		defer sorter.Close()
+
+		seen := make(map[string]bool)
+		for i := 0; i < 20000; i++ {
+			data := fmt.Sprintf("%08d", (i*7919)%3333)
+			Expect(sorter.Append([]byte(data))).To(Succeed())
+			seen[data] = true
+		}
+		expected := make([]string, 0, len(seen))
+		for data := range seen {
+			expected = append(expected, data)
+		}
+		sort.Strings(expected)
+
+		iter, err := sorter.Unique()
+		Expect(err).NotTo(HaveOccurred())
+		defer iter.Close()
+
+		var res []string
+		for iter.Next() {
+			res = append(res, string(iter.Data()))
+		}
+		Expect(iter.Err()).NotTo(HaveOccurred())
+		Expect(res).To(Equal(expected))
+	})
+
+	It("should flush in intervals", func() {
+		sorter := extsort.New(&extsort.Options{WorkDir: workDir, FlushInterval: 10 * time.Millisecond})
+		defer sorter.Close()
+
+		Expect(sorter.Append([]byte("foo"))).To(Succeed())
+		Eventually(sorter.RunSizes).Should(Equal([]int64{1}))
+		Expect(sorter.Spilled()).To(BeTrue())
+
+		Expect(sorter.AppendAll([][]byte{[]byte("bar"), []byte("baz"), []byte("dau")})).To(Succeed())
+		Expect(drain(sorter)).To(Equal([]string{"bar", "baz", "dau", "foo"}))
+	})
+
+	It("should expose the effective options", func() {
+		opt := subject.Options()
+		Expect(opt.WorkDir).To(Equal(workDir))
+		Expect(opt.BufferSize).To(Equal(1024 * 1024))
+		Expect(opt.FileSuffix).To(Equal(extsort.DefaultFileSuffix))
+		Expect(opt.Less).NotTo(BeNil())
+		Expect(opt.Sort).NotTo(BeNil())
+
+		opt.BufferSize = 1
+		Expect(subject.Options().BufferSize).To(Equal(1024 * 1024))
+
+		sorter := extsort.New(nil)
+		defer sorter.Close()
+		Expect(sorter.Options().BufferSize).To(Equal(64 * 1024 * 1024))
+	})
+
+	It("should report whether dedup is active", func() {
+		Expect(subject.DedupActive()).To(BeFalse())
+		Expect(subject.AppendAll([][]byte{[]byte("foo"), []byte("foo")})).To(Succeed())
+		Expect(drain(subject)).To(Equal([]string{"foo", "foo"}))
+
+		sorter := extsort.New(&extsort.Options{WorkDir: workDir, DedupScope: extsort.DedupPerRun})
+		defer sorter.Close()
+		Expect(sorter.DedupActive()).To(BeTrue())
+	})
+
+	It("should limit the number of output entries", func() {
+		sorter := extsort.New(&extsort.Options{WorkDir: workDir, MaxOutputEntries: 3})
+		defer sorter.Close()
+
+		Expect(sorter.AppendAll([][]byte{[]byte("foo"), []byte("bar"), []byte("baz")})).To(Succeed())
+		Expect(drain(sorter)).To(Equal([]string{"bar", "baz", "foo"}))
+
+		Expect(sorter.Append([]byte("dau"))).To(Succeed())
+		iter, err := sorter.Sort()
+		Expect(err).NotTo(HaveOccurred())
+		defer iter.Close()
+
+		res, err := iter.NextBatch(5)
+		Expect(res).To(HaveLen(3))
+		Expect(err).To(MatchError(extsort.ErrTooManyEntries))
+		Expect(iter.Next()).To(BeFalse())
+	})
+
+	It("should emit heartbeats", func() {
+		var beats int64
+		sorter := extsort.New(&extsort.Options{
+			WorkDir:           workDir,
+			OnHeartbeat:       func() { atomic.AddInt64(&beats, 1) },
+			HeartbeatInterval: 5 * time.Millisecond,
+		})
+		defer sorter.Close()
+
+		Expect(sorter.Append([]byte("foo"))).To(Succeed())
+		iter, err := sorter.Sort()
+		Expect(err).NotTo(HaveOccurred())
+
+		Eventually(func() int64 { return atomic.LoadInt64(&beats) }).Should(BeNumerically(">=", 2))
+		Expect(iter.Close()).To(Succeed())
+
+		n := atomic.LoadInt64(&beats)
+		Consistently(func() int64 { return atomic.LoadInt64(&beats) }, 30*time.Millisecond).Should(Equal(n))
+	})
+
+	It("should dedup", func() {
+		run := func(scope extsort.DedupScope) []string {
+			sorter := extsort.New(&extsort.Options{BufferSize: 64 * 1024, WorkDir: workDir, DedupScope: scope})
+			defer sorter.Close()
+
+			// three runs, each containing [00000000, 00000999] several times
+			for i := 0; i < 20000; i++ {
+				Expect(sorter.Append([]byte(fmt.Sprintf("%08d", i%1000)))).To(Succeed())
+			}
+			res, err := drain(sorter)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(sort.StringsAreSorted(res)).To(BeTrue())
+			return res
+		}
+
+		Expect(run(extsort.DedupNone)).To(HaveLen(20000))
+		Expect(run(extsort.DedupPerRun)).To(HaveLen(3000))
+		Expect(run(extsort.DedupGlobal)).To(HaveLen(1000))
+	})
+
+	It("should count comparisons", func() {
+		Expect(subject.Append([]byte("foo"))).To(Succeed())
+		Expect(subject.Append([]byte("bar"))).To(Succeed())
+		Expect(drain(subject)).To(HaveLen(2))
+		Expect(subject.Stats().Comparisons).To(BeZero())
+
+		sorter := extsort.New(&extsort.Options{BufferSize: 64 * 1024, WorkDir: workDir, CountComparisons: true})
+		defer sorter.Close()
+
+		Expect(appendShuffled(sorter, 20000, 20000)).To(Succeed())
+		Expect(sorter.Stats().Comparisons).To(BeNumerically(">", 0))
+
+		before := sorter.Stats().Comparisons
+		Expect(drain(sorter)).To(HaveLen(20000))
+		Expect(sorter.Stats().Comparisons).To(BeNumerically(">", before))
+	})
+
+	It("should checksum the output", func() {
+		checksum := func(bufferSize, n int) uint64 {
+			sorter := extsort.New(&extsort.Options{BufferSize: bufferSize, WorkDir: workDir, OutputChecksum: true})
+			defer sorter.Close()
+
+			Expect(appendShuffled(sorter, n, n)).To(Succeed())
+			iter, err := sorter.Sort()
+			Expect(err).NotTo(HaveOccurred())
+			defer iter.Close()
+
+			Expect(iter.Next()).To(BeTrue())
+			_, err = iter.OutputChecksum()
+			Expect(err).To(MatchError(extsort.ErrChecksumUnavailable))
+
+			for iter.Next() {
+			}
+			sum, err := iter.OutputChecksum()
+			Expect(err).NotTo(HaveOccurred())
+			return sum
+		}
+
+		sum := checksum(64*1024, 20000)
+		Expect(checksum(256*1024, 20000)).To(Equal(sum))
+		Expect(checksum(64*1024, 20001)).NotTo(Equal(sum))
+
+		// rewinding restarts the checksum, partial passes have none
+		sorter := extsort.New(&extsort.Options{BufferSize: 64 * 1024, WorkDir: workDir, OutputChecksum: true})
+		defer sorter.Close()
+
+		Expect(appendShuffled(sorter, 20000, 20000)).To(Succeed())
+		iter, err := sorter.Sort()
+		Expect(err).NotTo(HaveOccurred())
+		defer iter.Close()
+
+		start := iter.Cursor()
+		for n := 0; n < 5000 && iter.Next(); n++ {
+		}
+		middle := iter.Cursor()
+
+		Expect(iter.ResumeFrom(start)).To(Succeed())
+		for iter.Next() {
+		}
+		Expect(iter.OutputChecksum()).To(Equal(sum))
+
+		Expect(iter.ResumeFrom(middle)).To(Succeed())
+		for iter.Next() {
+		}
+		_, err = iter.OutputChecksum()
+		Expect(err).To(MatchError(extsort.ErrChecksumUnavailable))
+
+		Expect(subject.Append([]byte("foo"))).To(Succeed())
+		iter, err = subject.Sort()
+		Expect(err).NotTo(HaveOccurred())
+		defer iter.Close()
+
+		for iter.Next() {
+		}
+		_, err = iter.OutputChecksum()
+		Expect(err).To(MatchError(extsort.ErrChecksumUnavailable))
+	})
+
+	It("should delay spilling up to a threshold", func() {
+		run := func(n int) []int64 {
+			sorter := extsort.New(&extsort.Options{BufferSize: 64 * 1024, SpillThreshold: 256 * 1024, WorkDir: workDir})
+			defer sorter.Close()
+
+			Expect(appendShuffled(sorter, n, n)).To(Succeed())
+			sizes := sorter.RunSizes()
+			Expect(drain(sorter)).To(HaveLen(n))
+			return sizes
+		}
+
+		Expect(run(20000)).To(BeEmpty())
+		Expect(run(50000)).To(Equal([]int64{32768, 8192, 8192}))
+
+		// the threshold no longer applies once a background flush started
+		sorter := extsort.New(&extsort.Options{BufferSize: 64 * 1024, SpillThreshold: 256 * 1024, WorkDir: workDir, AsyncFlush: true})
+		defer sorter.Close()
+
+		Expect(appendShuffled(sorter, 50000, 50000)).To(Succeed())
+		Expect(drain(sorter)).To(HaveLen(50000))
+		Expect(sorter.RunSizes()).To(Equal([]int64{32768, 8192, 8192, 848}))
+	})
+
+	It("should target run entries", func() {
+		sorter := extsort.New(&extsort.Options{BufferSize: 64 * 1024, WorkDir: workDir, TargetRunEntries: 3000})
+		defer sorter.Close()
+
+		Expect(appendShuffled(sorter, 20000, 20000)).To(Succeed())
+		Expect(sorter.RunSizes()).To(Equal([]int64{3000, 3000, 3000, 3000, 3000, 3000}))
+		Expect(drain(sorter)).To(HaveLen(20000))
+
+		// BufferSize remains the upper bound
+		sorter = extsort.New(&extsort.Options{BufferSize: 64 * 1024, WorkDir: workDir, TargetRunEntries: 10000})
+		defer sorter.Close()
+
+		Expect(appendShuffled(sorter, 20000, 20000)).To(Succeed())
+		Expect(sorter.RunSizes()).NotTo(BeEmpty())
+		for _, n := range sorter.RunSizes() {
+			Expect(n).To(BeNumerically("<", 10000))
+		}
+	})
+
+	It("should observe comparisons", func() {
+		var observed, invalid int64
+		sorter := extsort.New(&extsort.Options{
+			BufferSize:       64 * 1024,
+			WorkDir:          workDir,
+			CountComparisons: true,
+			OnCompare: func(a, b []byte, less bool) {
+				atomic.AddInt64(&observed, 1)
+				if less != (bytes.Compare(a, b) < 0) {
+					atomic.AddInt64(&invalid, 1)
+				}
+			},
+		})
+		defer sorter.Close()
+
+		Expect(appendShuffled(sorter, 20000, 20000)).To(Succeed())
+		Expect(drain(sorter)).To(HaveLen(20000))
+		Expect(atomic.LoadInt64(&observed)).To(Equal(sorter.Stats().Comparisons))
+		Expect(atomic.LoadInt64(&invalid)).To(BeZero())
+	})
+
+	It("should optionally drain healthy runs on errors", func() {
+		run := func(bestEffort bool) ([]string, error) {
+			sorter := extsort.New(&extsort.Options{BufferSize: 64 * 1024, WorkDir: workDir, BestEffort: bestEffort})
+			defer sorter.Close()
+
+			Expect(appendShuffled(sorter, 20000, 20000)).To(Succeed())
+			iter, err := sorter.Sort()
+			Expect(err).NotTo(HaveOccurred())
+			defer iter.Close()
+
+			// corrupt the first run
+			entries, err := filepath.Glob(workDir + "/*")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(HaveLen(1))
+			f, err := os.OpenFile(entries[0], os.O_WRONLY, 0)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = f.WriteAt(bytes.Repeat([]byte{0xff}, 64), 40000)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(f.Close()).To(Succeed())
+
+			var res []string
+			for iter.Next() {
+				res = append(res, string(iter.Data()))
+			}
+			return res, iter.Err()
+		}
+
+		strict, err := run(false)
+		Expect(err).To(HaveOccurred())
+
+		lenient, err := run(true)
+		Expect(err).To(HaveOccurred())
+		Expect(sort.StringsAreSorted(lenient)).To(BeTrue())
+		Expect(len(lenient)).To(BeNumerically(">", len(strict)))
+		Expect(len(lenient)).To(BeNumerically(">", 15000))
+		Expect(len(lenient)).To(BeNumerically("<", 20000))
+	})
+
+	It("should consult section error handlers", func() {
+		var calls []int
+		var restore func()
+
+		sorter := extsort.New(&extsort.Options{
+			BufferSize: 64 * 1024,
+			WorkDir:    workDir,
+			OnSectionError: func(section int, err error) extsort.SectionAction {
+				calls = append(calls, section)
+				if restore != nil {
+					restore()
+					return extsort.SectionRetry
+				}
+				return extsort.SectionSkip
+			},
+		})
+		defer sorter.Close()
+
+		Expect(appendShuffled(sorter, 20000, 20000)).To(Succeed())
+		iter, err := sorter.Sort()
+		Expect(err).NotTo(HaveOccurred())
+		defer iter.Close()
+
+		entries, err := filepath.Glob(workDir + "/*")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+		f, err := os.OpenFile(entries[0], os.O_RDWR, 0)
+		Expect(err).NotTo(HaveOccurred())
+		defer f.Close()
+
+		orig := make([]byte, 64)
+		_, err = f.ReadAt(orig, 40000)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = f.WriteAt(bytes.Repeat([]byte{0xff}, 64), 40000)
+		Expect(err).NotTo(HaveOccurred())
+		restore = func() {
+			_, err := f.WriteAt(orig, 40000)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		res, err := iter.Collect()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(HaveLen(20000))
+		Expect(calls).To(Equal([]int{0}))
+	})
+
+	It("should resume from cursors", func() {
+		for _, comp := range []extsort.Compression{extsort.CompressionNone, extsort.CompressionGzip} {
+			sorter := extsort.New(&extsort.Options{
+				BufferSize:  64 * 1024,
+				WorkDir:     workDir,
+				Compression: comp,
+			})
+			Expect(appendShuffled(sorter, 20000, 20000)).To(Succeed())
+
+			iter, err := sorter.Sort()
+			Expect(err).NotTo(HaveOccurred())
+
+			for i := 0; i < 12345; i++ {
+				Expect(iter.Next()).To(BeTrue())
+			}
+			Expect(string(iter.Data())).To(Equal("00012344"))
+			cursor := iter.Cursor()
+
+			for i := 0; i < 100; i++ {
+				Expect(iter.Next()).To(BeTrue())
+			}
+			Expect(iter.ResumeFrom(cursor)).To(Succeed())
+
+			n := 12345
+			for iter.Next() {
+				Expect(string(iter.Data())).To(Equal(fmt.Sprintf("%08d", n)))
+				n++
+			}
+			Expect(iter.Err()).NotTo(HaveOccurred())
+			Expect(n).To(Equal(20000))
+
+			Expect(iter.ResumeFrom([]byte("bad"))).To(MatchError(extsort.ErrInvalidCursor))
+			Expect(iter.Close()).To(Succeed())
+			Expect(sorter.Close()).To(Succeed())
+		}
+	})
+
+	It("should return owned data", func() {
+		Expect(subject.AppendAll([][]byte{[]byte("foo"), []byte("bar"), []byte("baz")})).To(Succeed())
+		iter, err := subject.Sort()
+		Expect(err).NotTo(HaveOccurred())
+
+		var retained [][]byte
+		for iter.Next() {
+			retained = append(retained, iter.Data())
+		}
+		Expect(iter.Close()).To(Succeed())
+		Expect(retained).To(Equal([][]byte{[]byte("bar"), []byte("baz"), []byte("foo")}))
+	})
+
+	It("should append raw records by reference", func() {
+		var region []byte
+		for i := 0; i < 20000; i++ {
+			region = append(region, 8)
+			region = append(region, fmt.Sprintf("%08d", (i*7919)%20000)...)
+		}
+		orig := append([]byte(nil), region...)
+
+		sorter := extsort.New(&extsort.Options{BufferSize: 64 * 1024, WorkDir: workDir})
+		defer sorter.Close()
+
+		Expect(sorter.AppendRaw(region, func(region []byte) ([]byte, []byte, bool) {
+			n := int(region[0])
+			return region[1 : n+1], region[n+1:], true
+		})).To(Succeed())
+		for i := 0; i < 20000; i++ {
+			Expect(sorter.Append([]byte(fmt.Sprintf("x%07d", i)))).To(Succeed())
+		}
+		Expect(region).To(Equal(orig))
+
+		res, err := drain(sorter)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(HaveLen(40000))
+		Expect(sort.StringsAreSorted(res)).To(BeTrue())
+		Expect(res[:2]).To(Equal([]string{"00000000", "00000001"}))
+		Expect(region).To(Equal(orig))
+	})
+
+	It("should write output in different formats", func() {
+		write := func(format extsort.OutputFormat, items ...string) (string, error) {
+			sorter := extsort.New(&extsort.Options{WorkDir: workDir})
+			defer sorter.Close()
+
+			for _, item := range items {
+				Expect(sorter.Append([]byte(item))).To(Succeed())
+			}
+			iter, err := sorter.Sort()
+			Expect(err).NotTo(HaveOccurred())
+
+			buf := new(bytes.Buffer)
+			n, err := iter.WriteToFormat(buf, format)
+			Expect(n).To(Equal(int64(buf.Len())))
+			return buf.String(), err
+		}
+
+		Expect(write(extsort.OutputLines, "foo", "bar", "baz")).To(Equal("bar\nbaz\nfoo\n"))
+		Expect(write(extsort.OutputRaw, "foo", "bar", "baz")).To(Equal("barbazfoo"))
+		Expect(write(extsort.OutputFramed, "foo", "bar")).To(Equal("\x03bar\x03foo"))
+		Expect(write(extsort.OutputLinesEscaped, "a\nb", "c\\d")).To(Equal("a\\nb\nc\\\\d\n"))
+
+		out, err := write(extsort.OutputLines, "a", "b\nc")
+		Expect(err).To(MatchError(extsort.ErrNewlineInData))
+		Expect(out).To(Equal("a\n"))
+
+		_, err = write(extsort.OutputFormat(99), "a")
+		Expect(err).To(MatchError(extsort.ErrInvalidFormat))
+
+		Expect(subject.Append([]byte("foo"))).To(Succeed())
+		iter, err := subject.Sort()
+		Expect(err).NotTo(HaveOccurred())
+
+		buf := new(bytes.Buffer)
+		Expect(iter.WriteTo(buf)).To(Equal(int64(4)))
+		Expect(extsort.DecodeEntry(buf)).To(Equal([]byte("foo")))
+	})
+
+	It("should create independent iterators", func() {
+		Expect(appendShuffled(subject, 20000, 20000)).To(Succeed())
+
+		results := make([][][]byte, 4)
+		errs := make(chan error, len(results))
+		for n := range results {
+			iter, err := subject.NewIterator()
+			Expect(err).NotTo(HaveOccurred())
+
+			go func(n int, iter *extsort.Iterator) {
+				var err error
+				results[n], err = iter.Collect()
+				errs <- err
+			}(n, iter)
+		}
+		for range results {
+			Expect(<-errs).To(Succeed())
+		}
+		Expect(subject.RunSizes()).To(Equal([]int64{20000}))
+
+		for _, res := range results {
+			Expect(res).To(HaveLen(20000))
+			Expect(res).To(Equal(results[0]))
+		}
+	})
+
+	It("should create iterators while flushing in the background", func() {
+		sorter := extsort.New(&extsort.Options{BufferSize: 64 * 1024, WorkDir: workDir, AsyncFlush: true, FlushInterval: time.Millisecond})
+		defer sorter.Close()
+
+		Expect(appendShuffled(sorter, 20000, 20000)).To(Succeed())
+		for n := 0; n < 10; n++ {
+			iter, err := sorter.NewIterator()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(iter.Collect()).To(HaveLen(20000))
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	It("should split into ranges", func() {
+		sorter := extsort.New(&extsort.Options{BufferSize: 64 * 1024, WorkDir: workDir, DedupScope: extsort.DedupGlobal})
+		defer sorter.Close()
+
+		Expect(appendShuffled(sorter, 30000, 20000)).To(Succeed())
+
+		iter, err := sorter.Sort()
+		Expect(err).NotTo(HaveOccurred())
+		defer iter.Close()
+
+		for i := 0; i < 100; i++ {
+			Expect(iter.Next()).To(BeTrue())
+		}
+
+		ranges, err := iter.SplitRanges(4)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ranges).To(HaveLen(4))
+
+		results := make([][][]byte, len(ranges))
+		errs := make(chan error, len(ranges))
+		for n, sub := range ranges {
+			go func(n int, sub *extsort.Iterator) {
+				var err error
+				results[n], err = sub.Collect()
+				errs <- err
+			}(n, sub)
+		}
+		for range ranges {
+			Expect(<-errs).To(Succeed())
+		}
+
+		var res []string
+		for _, part := range results {
+			Expect(len(part)).To(BeNumerically("~", 4975, 1000))
+			for _, data := range part {
+				res = append(res, string(data))
+			}
+		}
+		Expect(res).To(HaveLen(19900))
+		for i, s := range res {
+			Expect(s).To(Equal(fmt.Sprintf("%08d", i+100)))
+		}
+	})
+
+	It("should split deduplicated output into ranges", func() {
+		newSorter := func(opt *extsort.Options) *extsort.Sorter {
+			opt.BufferSize = 64 * 1024
+			opt.WorkDir = workDir
+			opt.DedupScope = extsort.DedupGlobal
+			sorter := extsort.New(opt)
+			Expect(appendShuffled(sorter, 30000, 10000)).To(Succeed())
+			return sorter
+		}
+
+		plain := newSorter(&extsort.Options{})
+		defer plain.Close()
+		expected, err := drain(plain)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(expected).To(HaveLen(10000))
+
+		sorter := newSorter(&extsort.Options{})
+		defer sorter.Close()
+		iter, err := sorter.Sort()
+		Expect(err).NotTo(HaveOccurred())
+		defer iter.Close()
+
+		ranges, err := iter.SplitRanges(4)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ranges).To(HaveLen(4))
+
+		var res []string
+		for _, sub := range ranges {
+			part, err := sub.Collect()
+			Expect(err).NotTo(HaveOccurred())
+			for _, data := range part {
+				res = append(res, string(data))
+			}
+			Expect(sub.Close()).To(Succeed())
+		}
+		Expect(res).To(Equal(expected))
+
+		grouped := newSorter(&extsort.Options{EqualWithin: func(a, b []byte) bool { return bytes.Equal(a[:7], b[:7]) }})
+		defer grouped.Close()
+		iter, err = grouped.Sort()
+		Expect(err).NotTo(HaveOccurred())
+		defer iter.Close()
+
+		_, err = iter.SplitRanges(4)
+		Expect(err).To(MatchError(extsort.ErrSplitUnsupported))
+	})
+
+	It("should share the output limit between ranges", func() {
+		sorter := extsort.New(&extsort.Options{BufferSize: 64 * 1024, WorkDir: workDir, MaxOutputEntries: 1000})
+		defer sorter.Close()
+
+		Expect(appendShuffled(sorter, 20000, 20000)).To(Succeed())
+		iter, err := sorter.Sort()
+		Expect(err).NotTo(HaveOccurred())
+		defer iter.Close()
+
+		for i := 0; i < 100; i++ {
+			Expect(iter.Next()).To(BeTrue())
+		}
+		ranges, err := iter.SplitRanges(4)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ranges).To(HaveLen(4))
+
+		var total int
+		for _, sub := range ranges {
+			res, err := sub.NextBatch(20000)
+			Expect(err).To(Or(BeNil(), MatchError(extsort.ErrTooManyEntries)))
+			total += len(res)
+			Expect(sub.Close()).To(Succeed())
+		}
+		Expect(total).To(Equal(900))
+	})
+
+	It("should finalize to a file", func() {
+		dir, err := ioutil.TempDir("", "extsort-test")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		sorter := extsort.New(&extsort.Options{BufferSize: 64 * 1024, WorkDir: workDir, Compression: extsort.CompressionGzip})
+		defer sorter.Close()
+
+		Expect(appendShuffled(sorter, 20000, 20000)).To(Succeed())
+
+		path := filepath.Join(dir, "sorted")
+		iter, err := sorter.Finalize(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(filepath.Glob(workDir + "/*")).To(BeEmpty())
+		Expect(iter.ActiveSections()).To(Equal(1))
+
+		offsets := iter.Offsets()
+		snapshot, err := iter.Snapshot()
+		Expect(err).NotTo(HaveOccurred())
+
+		res, err := iter.Collect()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(HaveLen(20000))
+		Expect(sort.SliceIsSorted(res, func(i, j int) bool { return bytes.Compare(res[i], res[j]) < 0 })).To(BeTrue())
+		Expect(sorter.Close()).To(Succeed())
+
+		f, err := os.Open(path)
+		Expect(err).NotTo(HaveOccurred())
+		defer f.Close()
+
+		reread, err := extsort.ResumeIterator(f, offsets, snapshot, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reread.Collect()).To(Equal(res))
+	})
+
+	It("should verify runs", func() {
+		opt := &extsort.Options{BufferSize: 64 * 1024, WorkDir: workDir, Compression: extsort.CompressionGzip}
+		sorter := extsort.New(opt)
+		defer sorter.Close()
+
+		Expect(appendShuffled(sorter, 20000, 20000)).To(Succeed())
+		iter, err := sorter.Sort()
+		Expect(err).NotTo(HaveOccurred())
+		defer iter.Close()
+
+		Expect(iter.Offsets()).To(HaveLen(3))
+		Expect(extsort.VerifyRun(iter.ReaderAt(), iter.Offsets(), nil, opt)).To(Succeed())
+
+		reversed := &extsort.Options{
+			Compression: extsort.CompressionGzip,
+			Less:        func(a, b []byte) bool { return bytes.Compare(a, b) > 0 },
+		}
+		Expect(extsort.VerifyRun(iter.ReaderAt(), iter.Offsets(), nil, reversed)).To(MatchError(extsort.ErrOrderViolation))
 
-		Expect(compressed.Append([]byte("foo"))).To(Succeed())
-		Expect(compressed.Append([]byte("bar"))).To(Succeed())
-		Expect(compressed.Append([]byte("baz"))).To(Succeed())
-		Expect(compressed.Append([]byte("dau"))).To(Succeed())
-		Expect(drain(compressed)).To(Equal([]string{"bar", "baz", "dau", "foo"}))
+		buf := new(bytes.Buffer)
+		Expect(extsort.EncodeEntry(buf, []byte("foo"))).To(Succeed())
+		truncated := buf.Bytes()[:3]
+		Expect(extsort.VerifyRun(bytes.NewReader(truncated), []int64{3}, nil, nil)).To(MatchError(io.ErrUnexpectedEOF))
 	})
 
-	It("should compress temporary files", func() {
-		compressed := extsort.New(&extsort.Options{
-			BufferSize:  1024 * 1024,
+	It("should verify runs with mixed codecs", func() {
+		opt := &extsort.Options{
+			BufferSize: 64 * 1024,
+			WorkDir:    workDir,
+			SelectCodec: func(run int) extsort.Compression {
+				if run%2 == 0 {
+					return extsort.CompressionGzip
+				}
+				return extsort.CompressionNone
+			},
+		}
+		sorter := extsort.New(opt)
+		defer sorter.Close()
+
+		Expect(appendShuffled(sorter, 20000, 20000)).To(Succeed())
+		iter, err := sorter.Sort()
+		Expect(err).NotTo(HaveOccurred())
+		defer iter.Close()
+
+		Expect(iter.Codecs()).To(Equal([]extsort.Compression{extsort.CompressionGzip, extsort.CompressionNone, extsort.CompressionGzip}))
+		Expect(extsort.VerifyRun(iter.ReaderAt(), iter.Offsets(), iter.Codecs(), opt)).To(Succeed())
+		Expect(extsort.VerifyRun(iter.ReaderAt(), iter.Offsets(), nil, opt)).To(HaveOccurred())
+		Expect(extsort.VerifyRun(iter.ReaderAt(), iter.Offsets(), iter.Codecs()[:1], opt)).To(HaveOccurred())
+	})
+
+	It("should resume from snapshots", func() {
+		sorter := extsort.New(&extsort.Options{
+			BufferSize:  64 * 1024,
 			WorkDir:     workDir,
 			Compression: extsort.CompressionGzip,
 		})
-		defer compressed.Close()
+		defer sorter.Close()
 
-		for i := 0; i < 200; i++ {
-			Expect(compressed.Append([]byte("foo"))).To(Succeed())
+		Expect(appendShuffled(sorter, 20000, 20000)).To(Succeed())
+
+		iter, err := sorter.Sort()
+		Expect(err).NotTo(HaveOccurred())
+		defer iter.Close()
+
+		for i := 0; i < 12345; i++ {
+			Expect(iter.Next()).To(BeTrue())
 		}
-		Expect(drain(compressed)).To(HaveLen(200))
-		Expect(fileSize()).To(BeNumerically("~", 50, 5))
-	})
+		snapshot, err := iter.Snapshot()
+		Expect(err).NotTo(HaveOccurred())
 
-	It("should copy values", func() {
-		var val []byte
-		Expect(subject.Append(append(val[:0], "foo"...))).To(Succeed())
-		Expect(subject.Append(append(val[:0], "bar"...))).To(Succeed())
-		Expect(subject.Append(append(val[:0], "baz"...))).To(Succeed())
-		Expect(subject.Append(append(val[:0], "dau"...))).To(Succeed())
-		Expect(drain(subject)).To(Equal([]string{"bar", "baz", "dau", "foo"}))
-	})
+		for run := 0; run < 2; run++ {
+			resumed, err := extsort.ResumeIterator(iter.ReaderAt(), iter.Offsets(), snapshot, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resumed.ActiveSections()).To(Equal(iter.ActiveSections()))
 
-	It("should not fail when blank", func() {
-		Expect(drain(subject)).To(BeEmpty())
+			res, err := resumed.Collect()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(HaveLen(20000 - 12345))
+			Expect(string(res[0])).To(Equal("00012345"))
+			Expect(string(res[len(res)-1])).To(Equal("00019999"))
+		}
+
+		_, err = extsort.ResumeIterator(iter.ReaderAt(), iter.Offsets(), []byte("bad"), nil)
+		Expect(err).To(MatchError(extsort.ErrInvalidCursor))
+		_, err = extsort.ResumeIterator(iter.ReaderAt(), iter.Offsets(), []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}, nil)
+		Expect(err).To(MatchError(extsort.ErrInvalidCursor))
+		_, err = extsort.ResumeIterator(iter.ReaderAt(), iter.Offsets(), []byte{2, 0, 0, 0}, nil)
+		Expect(err).To(MatchError(extsort.ErrInvalidCursor))
 	})
 
 	It("should sort large data sets with constant memory", func() {
@@ -157,6 +1796,260 @@ var _ = Describe("Sorter", func() {
 	})
 })
 
+var _ = Describe("SortSlice", func() {
+	It("should sort in memory", func() {
+		data := [][]byte{[]byte("foo"), []byte("bar"), []byte("baz"), []byte("dau")}
+		extsort.SortSlice(data, nil)
+		Expect(data).To(Equal([][]byte{[]byte("bar"), []byte("baz"), []byte("dau"), []byte("foo")}))
+
+		extsort.SortSlice(data, func(a, b []byte) bool { return bytes.Compare(a, b) > 0 })
+		Expect(data).To(Equal([][]byte{[]byte("foo"), []byte("dau"), []byte("baz"), []byte("bar")}))
+	})
+})
+
+var _ = Describe("HybridSort", func() {
+	It("should sort", func() {
+		rnd := rand.New(rand.NewSource(33))
+		inputs := map[string][]int{
+			"random":   rnd.Perm(5000),
+			"sorted":   make([]int, 5000),
+			"reversed": make([]int, 5000),
+			"equal":    make([]int, 5000),
+			"few":      make([]int, 5000),
+			"tiny":     {2, 1},
+			"empty":    {},
+		}
+		for i := 0; i < 5000; i++ {
+			inputs["sorted"][i] = i
+			inputs["reversed"][i] = 5000 - i
+			inputs["few"][i] = rnd.Intn(3)
+		}
+
+		for _, threshold := range []int{0, 1, 12, 64} {
+			for name, input := range inputs {
+				data := append([]int(nil), input...)
+				extsort.HybridSort(threshold)(sort.IntSlice(data))
+				Expect(sort.IntsAreSorted(data)).To(BeTrue(), "%s with threshold %d", name, threshold)
+				Expect(data).To(HaveLen(len(input)))
+			}
+		}
+	})
+
+	It("should be used for small sort thresholds", func() {
+		sorter := extsort.New(&extsort.Options{BufferSize: 64 * 1024, SmallSortThreshold: 20})
+		defer sorter.Close()
+
+		Expect(appendShuffled(sorter, 20000, 20000)).To(Succeed())
+		iter, err := sorter.Sort()
+		Expect(err).NotTo(HaveOccurred())
+		res, err := iter.Collect()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(HaveLen(20000))
+		for i, data := range res {
+			Expect(string(data)).To(Equal(fmt.Sprintf("%08d", i)))
+		}
+	})
+})
+
+var _ = Describe("Plan", func() {
+	It("should estimate sorts", func() {
+		Expect(extsort.Plan(nil, 0)).To(Equal(extsort.SortPlan{
+			Runs:              1,
+			MergePasses:       1,
+			FinalFanIn:        1,
+			SectionBufferSize: 32 * 1024 * 1024,
+		}))
+
+		Expect(extsort.Plan(&extsort.Options{BufferSize: 1 << 20}, 10<<20)).To(Equal(extsort.SortPlan{
+			Runs:              10,
+			MergePasses:       1,
+			FinalFanIn:        10,
+			SectionBufferSize: (1 << 20) / 11,
+			DiskBytes:         10 << 20,
+		}))
+
+		Expect(extsort.Plan(&extsort.Options{BufferSize: 1 << 20, MergeWhenRuns: 4}, 10<<20)).To(Equal(extsort.SortPlan{
+			Runs:              10,
+			MergePasses:       3,
+			FinalFanIn:        2,
+			SectionBufferSize: (1 << 20) / 3,
+			DiskBytes:         18 << 20,
+		}))
+
+		Expect(extsort.Plan(&extsort.Options{BufferSize: 1 << 20, SpillThreshold: 4 << 20, MergeMemoryBudget: 1 << 20}, 10<<20)).To(Equal(extsort.SortPlan{
+			Runs:              7,
+			MergePasses:       1,
+			FinalFanIn:        7,
+			SectionBufferSize: (1 << 20) / 7,
+			DiskBytes:         10 << 20,
+		}))
+
+		Expect(extsort.Plan(&extsort.Options{BufferSize: 1 << 20, SpillThreshold: 16 << 20}, 10<<20).Runs).To(Equal(1))
+		Expect(extsort.Plan(&extsort.Options{BufferSize: 1 << 20, MemoryLimit: 512 << 10}, 10<<20).Runs).To(Equal(20))
+	})
+})
+
+var _ = Describe("Options", func() {
+	It("should expose the dedup function", func() {
+		Expect((*extsort.Options)(nil).DedupFunc()).To(BeNil())
+		Expect((&extsort.Options{}).DedupFunc()).To(BeNil())
+
+		equal := (&extsort.Options{DedupScope: extsort.DedupGlobal}).DedupFunc()
+		Expect(equal([]byte("foo"), []byte("foo"))).To(BeTrue())
+		Expect(equal([]byte("foo"), []byte("bar"))).To(BeFalse())
+
+		equal = (&extsort.Options{
+			DedupScope: extsort.DedupPerRun,
+			Less:       func(a, b []byte) bool { return a[0] < b[0] },
+		}).DedupFunc()
+		Expect(equal([]byte("foo"), []byte("fun"))).To(BeTrue())
+		Expect(equal([]byte("foo"), []byte("bar"))).To(BeFalse())
+
+		equal = (&extsort.Options{
+			DedupScope:  extsort.DedupGlobal,
+			EqualWithin: func(a, b []byte) bool { return len(a) == len(b) },
+		}).DedupFunc()
+		Expect(equal([]byte("foo"), []byte("bar"))).To(BeTrue())
+	})
+})
+
+var _ = Describe("EncodeEntry/DecodeEntry", func() {
+	It("should round-trip", func() {
+		buf := new(bytes.Buffer)
+		Expect(extsort.EncodeEntry(buf, []byte("foo"))).To(Succeed())
+		Expect(extsort.EncodeEntry(buf, nil)).To(Succeed())
+		Expect(extsort.EncodeEntry(buf, bytes.Repeat([]byte{'x'}, 300))).To(Succeed())
+		Expect(buf.Len()).To(Equal(4 + 1 + 302))
+
+		Expect(extsort.DecodeEntry(buf)).To(Equal([]byte("foo")))
+		Expect(extsort.DecodeEntry(buf)).To(Equal([]byte{}))
+		Expect(extsort.DecodeEntry(buf)).To(HaveLen(300))
+		_, err := extsort.DecodeEntry(buf)
+		Expect(err).To(Equal(io.EOF))
+
+		_, err = extsort.DecodeEntry(bytes.NewReader([]byte{5, 'a', 'b'}))
+		Expect(err).To(Equal(io.ErrUnexpectedEOF))
+	})
+
+	It("should reject corrupt lengths", func() {
+		_, err := extsort.DecodeEntry(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}))
+		Expect(err).To(MatchError(extsort.ErrInvalidEntry))
+
+		_, err = extsort.DecodeEntry(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 0x07, 'a', 'b'}))
+		Expect(err).To(Equal(io.ErrUnexpectedEOF))
+
+		buf := new(bytes.Buffer)
+		Expect(extsort.EncodeEntry(buf, bytes.Repeat([]byte{'x'}, 100000))).To(Succeed())
+		Expect(extsort.DecodeEntry(buf)).To(HaveLen(100000))
+	})
+
+	It("should match the temporary file format", func() {
+		workDir, err := ioutil.TempDir("", "extsort-test")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(workDir)
+
+		sorter := extsort.New(&extsort.Options{WorkDir: workDir})
+		defer sorter.Close()
+		Expect(sorter.AppendAll([][]byte{[]byte("foo"), []byte("bar")})).To(Succeed())
+		iter, err := sorter.Sort()
+		Expect(err).NotTo(HaveOccurred())
+		defer iter.Close()
+
+		entries, err := filepath.Glob(workDir + "/*")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+		f, err := os.Open(entries[0])
+		Expect(err).NotTo(HaveOccurred())
+		defer f.Close()
+
+		Expect(extsort.DecodeEntry(f)).To(Equal([]byte("bar")))
+		Expect(extsort.DecodeEntry(f)).To(Equal([]byte("foo")))
+		_, err = extsort.DecodeEntry(f)
+		Expect(err).To(Equal(io.EOF))
+	})
+})
+
+var _ = Describe("Join", func() {
+	var workDir string
+
+	BeforeEach(func() {
+		var err error
+		workDir, err = ioutil.TempDir("", "extsort-test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(workDir)).To(Succeed())
+	})
+
+	join := func(mode extsort.JoinMode) []string {
+		sorted := func(items ...string) (*extsort.Sorter, *extsort.Iterator) {
+			sorter := extsort.New(&extsort.Options{WorkDir: workDir})
+			for _, item := range items {
+				Expect(sorter.Append([]byte(item))).To(Succeed())
+			}
+			iter, err := sorter.Sort()
+			Expect(err).NotTo(HaveOccurred())
+			return sorter, iter
+		}
+
+		ls, left := sorted("d", "a", "b", "b", "e")
+		defer ls.Close()
+		rs, right := sorted("b", "c", "b", "f", "d", "d")
+		defer rs.Close()
+
+		iter := extsort.Join(nil, left, right, mode)
+		defer iter.Close()
+
+		var res []string
+		for iter.Next() {
+			res = append(res, string(iter.Left())+":"+string(iter.Right()))
+		}
+		Expect(iter.Err()).NotTo(HaveOccurred())
+		return res
+	}
+
+	It("should join inner", func() {
+		Expect(join(extsort.JoinInner)).To(Equal([]string{
+			"b:b", "b:b", "b:b", "b:b", "d:d", "d:d",
+		}))
+	})
+
+	It("should join left", func() {
+		Expect(join(extsort.JoinLeft)).To(Equal([]string{
+			"a:", "b:b", "b:b", "b:b", "b:b", "d:d", "d:d", "e:",
+		}))
+	})
+
+	It("should join outer", func() {
+		Expect(join(extsort.JoinOuter)).To(Equal([]string{
+			"a:", "b:b", "b:b", "b:b", "b:b", ":c", "d:d", "d:d", "e:", ":f",
+		}))
+	})
+})
+
+var _ = Describe("testutil", func() {
+	It("should generate deterministic keys", func() {
+		keys := testutil.GenerateKeys(100, 8, 33)
+		Expect(keys).To(HaveLen(100))
+		Expect(keys[0]).To(HaveLen(8))
+		Expect(keys).To(Equal(testutil.GenerateKeys(100, 8, 33)))
+		Expect(keys).NotTo(Equal(testutil.GenerateKeys(100, 8, 34)))
+
+		sorter := extsort.New(nil)
+		defer sorter.Close()
+
+		Expect(testutil.FeedSorter(sorter, 100, 8, 33)).To(Succeed())
+		iter, err := sorter.Sort()
+		Expect(err).NotTo(HaveOccurred())
+		res, err := iter.Collect()
+		Expect(err).NotTo(HaveOccurred())
+
+		sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+		Expect(res).To(Equal(keys))
+	})
+})
+
 // --------------------------------------------------------------------
 
 func TestSuite(t *testing.T) {
@@ -193,11 +2086,31 @@ func seedData() (string, error) {
 	return f.Name(), f.Close()
 }
 
+type testMetrics struct {
+	runs, written int64
+	passes        []int
+}
+
+func (m *testMetrics) IncRuns()                   { atomic.AddInt64(&m.runs, 1) }
+func (m *testMetrics) AddBytesWritten(n int64)    { atomic.AddInt64(&m.written, n) }
+func (m *testMetrics) ObserveMergePass(fanIn int) { m.passes = append(m.passes, fanIn) }
+
 type fixture struct {
 	*bufio.Scanner
 	f *os.File
 }
 
+// appendShuffled appends n zero-padded numbers in [0, max) to the sorter,
+// in a reproducible, shuffled order.
+func appendShuffled(s *extsort.Sorter, n, max int) error {
+	for i := 0; i < n; i++ {
+		if err := s.Append([]byte(fmt.Sprintf("%08d", (i*7919)%max))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func seedFixture() (*fixture, error) {
 	fn, err := seedData()
 	if err != nil {
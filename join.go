@@ -0,0 +1,171 @@
+package extsort
+
+// JoinMode defines which items are emitted by a JoinIterator.
+type JoinMode uint8
+
+// Supported join modes.
+const (
+	// JoinInner emits pairs of equal items present on both sides.
+	JoinInner JoinMode = iota
+	// JoinLeft additionally emits left items without a match.
+	JoinLeft
+	// JoinOuter additionally emits left and right items without a match.
+	JoinOuter
+)
+
+// JoinIterator joins two sorted iterators, see Join.
+type JoinIterator struct {
+	less Less
+	mode JoinMode
+
+	left, right *joinSide
+
+	lgroup, rgroup [][]byte
+	li, ri         int
+
+	ldata, rdata []byte
+	err          error
+}
+
+// Join creates a sort-merge join of two iterators, which must both be
+// sorted according to opt.Less. Items are matched if neither is less than
+// the other. Duplicate items on both sides emit their cross product.
+func Join(opt *Options, left, right *Iterator, mode JoinMode) *JoinIterator {
+	opt = opt.norm()
+	return &JoinIterator{
+		less:  opt.Less,
+		mode:  mode,
+		left:  &joinSide{iter: left},
+		right: &joinSide{iter: right},
+	}
+}
+
+// Next advances the iterator to the next pair and returns true if
+// successful.
+func (j *JoinIterator) Next() bool {
+	if j.err != nil {
+		return false
+	}
+
+	// emit the cross product of the current groups
+	if j.ri < len(j.rgroup) {
+		j.ldata, j.rdata = j.lgroup[j.li], j.rgroup[j.ri]
+		if j.li++; j.li == len(j.lgroup) {
+			j.li, j.ri = 0, j.ri+1
+		}
+		return true
+	}
+	j.lgroup, j.rgroup = j.lgroup[:0], j.rgroup[:0]
+	j.li, j.ri = 0, 0
+
+	for {
+		l, lok := j.left.peek()
+		r, rok := j.right.peek()
+		if err := j.left.err; err != nil {
+			j.err = err
+			return false
+		} else if err := j.right.err; err != nil {
+			j.err = err
+			return false
+		}
+
+		switch {
+		case !lok && !rok:
+			return false
+		case !rok || (lok && j.less(l, r)):
+			if j.mode == JoinInner && !rok {
+				return false
+			}
+			j.left.next()
+			if j.mode != JoinInner {
+				j.ldata, j.rdata = l, nil
+				return true
+			}
+		case !lok || j.less(r, l):
+			if j.mode != JoinOuter && !lok {
+				return false
+			}
+			j.right.next()
+			if j.mode == JoinOuter {
+				j.ldata, j.rdata = nil, r
+				return true
+			}
+		default:
+			j.lgroup = j.left.group(j.lgroup, l, j.less)
+			j.rgroup = j.right.group(j.rgroup, r, j.less)
+			if j.err = j.left.err; j.err == nil {
+				j.err = j.right.err
+			}
+			if j.err != nil {
+				return false
+			}
+			return j.Next()
+		}
+	}
+}
+
+// Left returns the left item of the current pair, nil if there was no
+// match on the left side.
+func (j *JoinIterator) Left() []byte {
+	return j.ldata
+}
+
+// Right returns the right item of the current pair, nil if there was no
+// match on the right side.
+func (j *JoinIterator) Right() []byte {
+	return j.rdata
+}
+
+// Err returns the error, if occurred.
+func (j *JoinIterator) Err() error {
+	return j.err
+}
+
+// Close closes both iterators.
+func (j *JoinIterator) Close() error {
+	err := j.left.iter.Close()
+	if e := j.right.iter.Close(); e != nil {
+		err = e
+	}
+	return err
+}
+
+// --------------------------------------------------------------------
+
+type joinSide struct {
+	iter    *Iterator
+	data    []byte
+	peeked  bool
+	drained bool
+	err     error
+}
+
+// peek returns the next item without consuming it.
+func (s *joinSide) peek() ([]byte, bool) {
+	if !s.peeked && !s.drained {
+		if s.iter.Next() {
+			s.data, s.peeked = s.iter.Data(), true
+		} else {
+			s.drained = true
+			s.err = s.iter.Err()
+		}
+	}
+	return s.data, s.peeked
+}
+
+// next consumes the peeked item.
+func (s *joinSide) next() {
+	s.data, s.peeked = nil, false
+}
+
+// group consumes all items equal to key and appends them to dst.
+func (s *joinSide) group(dst [][]byte, key []byte, less Less) [][]byte {
+	for {
+		data, ok := s.peek()
+		if !ok || less(key, data) {
+			return dst
+		}
+		dst = append(dst, data)
+		s.next()
+	}
+}
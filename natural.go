@@ -0,0 +1,86 @@
+package extsort
+
+// LessNatural compares byte chunks in natural order, i.e. it splits them
+// into text and numeric segments and compares numbers by their value.
+// For example "name-9" is ordered before "name-10". If two numbers have the
+// same value, the one with fewer leading zeros is ordered first, unless the
+// remainder of the chunks differs. It can be used as Options.Less.
+func LessNatural(a, b []byte) bool {
+	return compareNatural(a, b) < 0
+}
+
+func compareNatural(a, b []byte) int {
+	i, j, tie := 0, 0, 0
+	for i < len(a) && j < len(b) {
+		ca, cb := a[i], b[j]
+		if !isDigit(ca) || !isDigit(cb) {
+			if ca != cb {
+				if ca < cb {
+					return -1
+				}
+				return 1
+			}
+			i++
+			j++
+			continue
+		}
+
+		// skip leading zeros
+		za, zb := i, j
+		for i < len(a) && a[i] == '0' {
+			i++
+		}
+		for j < len(b) && b[j] == '0' {
+			j++
+		}
+		za, zb = i-za, j-zb
+
+		// find the end of the numeric segments
+		ea, eb := i, j
+		for ea < len(a) && isDigit(a[ea]) {
+			ea++
+		}
+		for eb < len(b) && isDigit(b[eb]) {
+			eb++
+		}
+
+		// longer numbers are greater
+		if na, nb := ea-i, eb-j; na != nb {
+			if na < nb {
+				return -1
+			}
+			return 1
+		}
+
+		// same length, compare digit by digit
+		for ; i < ea; i, j = i+1, j+1 {
+			if a[i] != b[j] {
+				if a[i] < b[j] {
+					return -1
+				}
+				return 1
+			}
+		}
+
+		// same value, remember fewer leading zeros as a tie-breaker
+		if tie == 0 && za != zb {
+			if za < zb {
+				tie = -1
+			} else {
+				tie = 1
+			}
+		}
+	}
+
+	switch {
+	case len(a)-i < len(b)-j:
+		return -1
+	case len(a)-i > len(b)-j:
+		return 1
+	}
+	return tie
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,57 @@
+package extsort_test
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/bsm/extsort"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LessNatural", func() {
+	less := func(a, b string) bool {
+		return extsort.LessNatural([]byte(a), []byte(b))
+	}
+
+	It("should compare numbers by value", func() {
+		Expect(less("name-9", "name-10")).To(BeTrue())
+		Expect(less("name-10", "name-9")).To(BeFalse())
+		Expect(less("name-10", "name-10")).To(BeFalse())
+		Expect(less("9", "10")).To(BeTrue())
+		Expect(less("a2b10", "a2b9")).To(BeFalse())
+		Expect(less("a2b9", "a10b1")).To(BeTrue())
+		Expect(less("123456789012345678901234567890", "123456789012345678901234567891")).To(BeTrue())
+	})
+
+	It("should handle leading zeros", func() {
+		Expect(less("x007", "x8")).To(BeTrue())
+		Expect(less("x010", "x9")).To(BeFalse())
+		Expect(less("x1", "x01")).To(BeTrue())
+		Expect(less("x01", "x1")).To(BeFalse())
+		Expect(less("x0", "x00")).To(BeTrue())
+		Expect(less("x01y2", "x1y3")).To(BeTrue())
+		Expect(less("x01y3", "x1y3")).To(BeFalse())
+		Expect(less("x1y3", "x01y3")).To(BeTrue())
+	})
+
+	It("should compare text segments", func() {
+		Expect(less("", "a")).To(BeTrue())
+		Expect(less("a", "")).To(BeFalse())
+		Expect(less("abc", "abd")).To(BeTrue())
+		Expect(less("ab", "ab1")).To(BeTrue())
+		Expect(less("a1", "ab")).To(BeTrue())
+	})
+
+	It("should sort", func() {
+		data := []string{"f-10", "f-9", "f-1", "f-0010", "e", "f-01", "f-100"}
+		sort.Slice(data, func(i, j int) bool { return less(data[i], data[j]) })
+		Expect(data).To(Equal([]string{"e", "f-1", "f-01", "f-9", "f-10", "f-0010", "f-100"}))
+	})
+
+	It("should not allocate", func() {
+		a, b := []byte("name-0012-abc"), []byte("name-12-abd")
+		Expect(testing.AllocsPerRun(100, func() { extsort.LessNatural(a, b) })).To(BeZero())
+	})
+})
@@ -2,6 +2,11 @@ package extsort
 
 import (
 	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"sort"
+	"time"
 )
 
 // Less compares byte chunks.
@@ -11,22 +16,349 @@ func stdLess(a, b []byte) bool {
 	return bytes.Compare(a, b) < 0
 }
 
+// Equal tests byte chunks for equality.
+type Equal func(a, b []byte) bool
+
+// DedupScope defines the scope in which duplicates are removed. Two items
+// are considered duplicates if neither is less than the other. Only the
+// first of each set of duplicates is retained.
+type DedupScope uint8
+
+// Supported dedup scopes.
+const (
+	// DedupNone retains all duplicates.
+	DedupNone DedupScope = iota
+	// DedupPerRun removes duplicates within each flushed run only,
+	// duplicates across runs are retained.
+	DedupPerRun
+	// DedupGlobal removes all duplicates from the output.
+	DedupGlobal
+)
+
+// SectionAction defines how to handle errors while reading sections (runs)
+// during the merge, see Options.OnSectionError.
+type SectionAction uint8
+
+// Supported section actions.
+const (
+	// SectionAbort stops the iteration and reports the error.
+	SectionAbort SectionAction = iota
+	// SectionSkip skips the remainder of the section and continues with
+	// the others. The error is still reported by Iterator.Err once the
+	// iteration is complete.
+	SectionSkip
+	// SectionRetry re-opens the section and retries the failed read.
+	SectionRetry
+)
+
+// TieBreak defines the order of items which are neither less nor greater
+// than each other.
+type TieBreak uint8
+
+// Supported tie-breaks.
+const (
+	// TieBreakUndefined leaves the order of equal items undefined, but
+	// reproducible for identical input.
+	TieBreakUndefined TieBreak = iota
+	// TieBreakByValue orders equal items lexically by their bytes.
+	TieBreakByValue
+	// TieBreakBySection retains the order in which equal items were
+	// appended. Runs are sorted with sort.Stable, overriding Options.Sort.
+	TieBreakBySection
+	// TieBreakRoundRobin interleaves equal items across runs, taking one
+	// item from each run in turn. Within a run, equal items retain the
+	// order in which they were appended.
+	TieBreakRoundRobin
+)
+
 // Options contains sorting options
 type Options struct {
 	// WorkDir specifies the working directory.
 	// By default os.TempDir() is used.
 	WorkDir string
 
-	// Less defines the compare function.
-	// Default: bytes.Compare() < 0
+	// FileSuffix specifies the name suffix of temporary files.
+	// Default: DefaultFileSuffix
+	FileSuffix string
+
+	// OpenTempFile optionally overrides the creation of temporary files in
+	// (Work)dir. The returned file must be writable and must be possible
+	// to re-open via its Name for reading. It is removed on Close.
+	// Default: ioutil.TempFile
+	OpenTempFile func(dir string) (*os.File, error)
+
+	// CreateWorkDir creates WorkDir (including parents) if it does not
+	// exist yet. Otherwise, a missing WorkDir causes Append and Sort
+	// to fail.
+	CreateWorkDir bool
+
+	// Less defines the compare function. When nil, data is sorted
+	// lexically, i.e. a is ordered before b if bytes.Compare(a, b) < 0.
 	Less Less
 
+	// SortKey optionally derives a cheaply comparable key from each data
+	// chunk. When set, chunks are ordered lexically by their keys instead
+	// of Less. Keys are computed once per chunk for each run sort and for
+	// each merge, which avoids repeating expensive parsing on every
+	// comparison, but holds all keys of a run in memory while sorting.
+	// The output consists of the original chunks.
+	//
+	// Other comparisons, i.e. dedup, DedupFunc, SplitRanges bounds and
+	// DebugAssertions, use a Less derived from SortKey, which computes
+	// both keys on every call.
+	SortKey func(data []byte) []byte
+
+	// MergeLess optionally overrides the order in which items from
+	// different runs are emitted by the merge, while Less still sorts
+	// the runs and detects duplicates. Since runs are sorted by Less,
+	// MergeLess must be consistent with it: it may only order items which
+	// Less considers equal, and such items are only reordered across runs.
+	// When deduplicating, the first item in MergeLess order is retained.
+	MergeLess Less
+
+	// Sort defines the function used to sort each run in memory. Custom
+	// functions must order data consistently with Less, but may arrange
+	// equal items in any order.
+	// Default: DefaultSort
+	Sort func(sort.Interface)
+
+	// SmallSortThreshold optionally sorts runs with HybridSort, switching
+	// to insertion sort for ranges of up to the given number of items.
+	// It is ignored if a custom Sort is set.
+	SmallSortThreshold int
+
+	// TieBreak defines the order of equal items in the output. Defined
+	// tie-breaks cost an extra comparison for equal items.
+	// Default: TieBreakUndefined
+	TieBreak TieBreak
+
 	// BufferSize limits the memory buffer used for sorting.
 	// Default: 64MiB (must be at least 64KiB)
 	BufferSize int
 
+	// SpillThreshold optionally allows the buffer to grow beyond BufferSize
+	// until the first run is written. Inputs below the threshold are
+	// sorted as a single run, larger inputs spill once the threshold is
+	// reached and are then flushed at BufferSize as usual. Please note
+	// that memory usage may peak at SpillThreshold rather than BufferSize.
+	SpillThreshold int
+
+	// ExpectedEntries is an optional hint for the number of entries
+	// per run, used to pre-allocate the memory buffer. It is not a limit.
+	ExpectedEntries int
+
+	// TargetRunEntries optionally limits the number of entries per run,
+	// producing runs of even lengths. BufferSize remains the upper bound,
+	// runs are flushed once either limit is reached.
+	TargetRunEntries int
+
+	// GrowthFactor controls the growth of the memory buffer's index when
+	// it runs out of capacity. Smaller factors (e.g. 1.1) reduce memory
+	// spikes at the cost of more frequent reallocations. Factors below or
+	// equal to 1 are ignored.
+	// Default: built-in append growth
+	GrowthFactor float64
+
+	// AsyncFlush enables flushing of full buffers in the background
+	// while Append continues to fill a second buffer. Only a single flush
+	// is outstanding at any time, errors are returned by the next call
+	// to Append or Sort. Please note that this doubles the amount of
+	// memory used for buffering.
+	AsyncFlush bool
+
+	// RejectEmpty makes Append return ErrEmptyData for empty data
+	// instead of accepting it.
+	RejectEmpty bool
+
+	// MaxDataSize optionally limits the size of data chunks accepted by
+	// Append. Larger chunks are rejected with ErrDataTooLarge, unless
+	// TruncateData is set.
+	MaxDataSize int
+
+	// TruncateData makes Append truncate chunks to MaxDataSize instead
+	// of rejecting them.
+	TruncateData bool
+
+	// MemoryLimit optionally limits the summed length of the chunks
+	// buffered in memory, see Sorter.CanFit. The buffer is flushed before
+	// it would exceed the limit, regardless of BufferSize and
+	// SpillThreshold. With AsyncFlush, each of the two buffers is limited
+	// to half of it. Please note that the limit does not include the
+	// buffer's index or any spare capacity retained for reuse, so actual
+	// memory usage is higher.
+	MemoryLimit int
+
+	// StrictMemory makes Append return ErrMemoryLimit for data which
+	// cannot be buffered within MemoryLimit.
+	StrictMemory bool
+
+	// DedupScope optionally removes duplicates. Dedup is never enabled
+	// implicitly, e.g. by a custom Less or DedupResolve.
+	// Default: DedupNone (all duplicates are retained)
+	DedupScope DedupScope
+
+	// DedupResolve optionally picks the surviving item from two duplicates
+	// and is called repeatedly for sets of more than two duplicates. The
+	// result must not be less or greater than either of the arguments.
+	// Default: the first item (in sort order) is retained
+	DedupResolve func(a, b []byte) []byte
+
+	// EqualWithin optionally replaces the default equality used to detect
+	// duplicates, e.g. to treat numeric keys within a tolerance as equal.
+	// Such functions are usually not transitive, therefore each item is
+	// only compared with its immediate predecessor in sort order.
+	// Default: items are equal if neither is less than the other
+	EqualWithin Equal
+
+	// DedupWindow optionally collapses items which fall within a window
+	// of the first item of each set of duplicates, in sort order. Unlike
+	// EqualWithin, sets cannot grow beyond the window. The window must
+	// align with the sort order, i.e. if a is within the window of c, so
+	// must be every b between a and c. Ignored if EqualWithin is set.
+	DedupWindow Equal
+
+	// BestEffort continues to iterate over the remaining runs when one of
+	// them fails to read. The error is still reported by Iterator.Err,
+	// but the output will be incomplete.
+	BestEffort bool
+
+	// DebugAssertions verifies that the merged output is in order and
+	// fails with ErrOrderViolation otherwise. This is useful to detect
+	// inconsistent Less functions in tests, but costs an extra comparison
+	// per item.
+	DebugAssertions bool
+
+	// MaxOutputEntries optionally aborts the iteration with
+	// ErrTooManyEntries as soon as the output exceeds the given number of
+	// entries. The limit is not applied to MergeWhenRuns merges.
+	// Repositioning an iterator, e.g. with ResumeFrom, resets the count.
+	MaxOutputEntries int64
+
+	// OutputChecksum enables hashing of the output, see
+	// Iterator.OutputChecksum. Hashing adds a small overhead to each item.
+	OutputChecksum bool
+
+	// FlushInterval optionally flushes buffered data to disk in regular
+	// intervals, even if the buffer is not full yet.
+	FlushInterval time.Duration
+
+	// OnHeartbeat is optionally called in regular intervals while an
+	// iterator is open, independently of how quickly the output is
+	// consumed. It must not block.
+	OnHeartbeat func()
+
+	// HeartbeatInterval specifies the interval of OnHeartbeat calls.
+	// Default: 1s
+	HeartbeatInterval time.Duration
+
+	// MergeWhenRuns optionally merges all runs into a single one as soon as
+	// more than the given number of runs have been written. This spreads
+	// the merge cost over the ingest phase, but rewrites all data written
+	// so far on every merge. Merges run as part of the flush, i.e. in the
+	// background if AsyncFlush is enabled.
+	MergeWhenRuns int
+
+	// MergeMemoryBudget optionally defines the total size of the read
+	// buffers used while merging. The budget is split proportionally to
+	// the stored size of each run, with a minimum of 4KiB per run.
+	// Default: BufferSize, split evenly across all runs
+	MergeMemoryBudget int
+
+	// OnRunFlushed is optionally called after each run has been written
+	// to disk. The run is stored as section index of r, i.e. between
+	// offsets[index-1] (or 0) and offsets[index], compressed with
+	// codecs[index]. Neither r, offsets nor codecs must be retained after
+	// the call returns. Returning an error aborts the sort. Requires files
+	// returned by OpenTempFile to be readable. Please note that with
+	// MergeWhenRuns, sections written before a merge no longer correspond
+	// to individual runs and index counts the sections of the merged file.
+	OnRunFlushed func(index int, r io.ReaderAt, offsets []int64, codecs []Compression) error
+
+	// OnSectionError is optionally called when a section (run) fails to
+	// read during the merge and decides how to proceed. Please note that
+	// returning SectionRetry indefinitely for permanent errors will loop
+	// forever. Takes precedence over BestEffort.
+	// Default: SectionAbort (or SectionSkip with BestEffort)
+	OnSectionError func(section int, err error) SectionAction
+
 	// Compression optionally uses compression for temporary output.
 	Compression Compression
+
+	// SelectCodec optionally selects the compression for each run, by the
+	// index of the run, and takes precedence over Compression. Runs merged
+	// by MergeWhenRuns or Finalize use the codec of the last run.
+	SelectCodec func(run int) Compression
+
+	// CompressMinBytes disables compression for runs which contain fewer
+	// than the given number of bytes. Merged runs are measured by their
+	// stored size.
+	CompressMinBytes int
+
+	// CompressionLevel sets the gzip compression level, from
+	// gzip.HuffmanOnly to gzip.BestCompression. The zero value selects the
+	// default rather than gzip.NoCompression, use CompressionNone to
+	// disable compression altogether. Invalid levels are reported by the
+	// first call to Append or Sort.
+	// Default: gzip.BestSpeed
+	CompressionLevel int
+
+	// CountComparisons enables counting of comparisons, see Sorter.Stats.
+	// Counting adds a small overhead to each comparison.
+	CountComparisons bool
+
+	// OnCompare is an optional debug hook, called with the arguments and
+	// the result of each invocation of Less while sorting and merging.
+	// Comparisons of SortKey are not reported.
+	OnCompare func(a, b []byte, less bool)
+
+	// Metrics optionally receives live updates of sorting metrics.
+	Metrics Metrics
+
+	// FrequencySketch enables tracking of approximate data frequencies
+	// during Append, see Sorter.Frequency.
+	FrequencySketch bool
+}
+
+// memoryLimit returns the limit of a single buffer, derived from
+// MemoryLimit. With AsyncFlush, the limit is shared by two buffers.
+func (o *Options) memoryLimit() int {
+	if o.AsyncFlush {
+		return o.MemoryLimit / 2
+	}
+	return o.MemoryLimit
+}
+
+// runLimit returns the number of bytes buffered before a run is flushed,
+// either for the first run or for any subsequent one.
+func (o *Options) runLimit(first bool) int {
+	limit := o.BufferSize
+	if first && o.SpillThreshold > limit {
+		limit = o.SpillThreshold
+	}
+	if max := o.memoryLimit(); max > 0 && limit > max {
+		limit = max
+	}
+	return limit
+}
+
+// DedupFunc returns the equality used to detect duplicates, i.e.
+// EqualWithin, DedupWindow or, by default, two chunks are equal if neither
+// is less than the other. It returns nil if DedupScope is DedupNone.
+func (o *Options) DedupFunc() Equal {
+	opt := o.norm()
+	if opt.DedupScope == DedupNone {
+		return nil
+	}
+	if opt.EqualWithin != nil {
+		return opt.EqualWithin
+	} else if opt.DedupWindow != nil {
+		return opt.DedupWindow
+	}
+
+	less := opt.Less
+	return func(a, b []byte) bool {
+		return !less(a, b) && !less(b, a)
+	}
 }
 
 func (o *Options) norm() *Options {
@@ -35,10 +367,28 @@ func (o *Options) norm() *Options {
 		opt = *o
 	}
 
-	if opt.Less == nil {
+	if opt.FileSuffix == "" {
+		opt.FileSuffix = DefaultFileSuffix
+	}
+
+	if sortKey := opt.SortKey; sortKey != nil {
+		opt.Less = func(a, b []byte) bool {
+			return bytes.Compare(sortKey(a), sortKey(b)) < 0
+		}
+	} else if opt.Less == nil {
 		opt.Less = stdLess
 	}
 
+	if opt.Sort == nil && opt.SmallSortThreshold > 0 {
+		opt.Sort = HybridSort(opt.SmallSortThreshold)
+	} else if opt.Sort == nil {
+		opt.Sort = DefaultSort
+	}
+
+	if opt.GrowthFactor <= 1 {
+		opt.GrowthFactor = 0
+	}
+
 	if std := (1 << 26); opt.BufferSize < 1 {
 		opt.BufferSize = std
 	} else if min := (1 << 16); opt.BufferSize < min {
@@ -47,5 +397,13 @@ func (o *Options) norm() *Options {
 
 	opt.Compression = opt.Compression.norm()
 
+	if opt.CompressionLevel == 0 {
+		opt.CompressionLevel = gzip.BestSpeed
+	}
+
+	if opt.HeartbeatInterval <= 0 {
+		opt.HeartbeatInterval = time.Second
+	}
+
 	return &opt
 }
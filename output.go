@@ -0,0 +1,113 @@
+package extsort
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var (
+	// ErrNewlineInData is returned by Iterator.WriteToFormat when data
+	// containing newlines is written with OutputLines.
+	ErrNewlineInData = errors.New("extsort: newline in data")
+	// ErrInvalidFormat is returned by Iterator.WriteToFormat for unknown
+	// output formats.
+	ErrInvalidFormat = errors.New("extsort: invalid output format")
+)
+
+// OutputFormat defines the framing of output written by
+// Iterator.WriteToFormat.
+type OutputFormat uint8
+
+// Supported output formats.
+const (
+	// OutputFramed writes each item with a length prefix, see EncodeEntry.
+	// The output can be read back with DecodeEntry.
+	OutputFramed OutputFormat = iota
+	// OutputLines writes each item followed by a newline and fails with
+	// ErrNewlineInData if an item contains a newline.
+	OutputLines
+	// OutputLinesEscaped writes each item followed by a newline, escaping
+	// newlines within items as `\n` and backslashes as `\\`.
+	OutputLinesEscaped
+	// OutputRaw concatenates all items without any framing.
+	OutputRaw
+)
+
+// WriteTo writes all remaining items to w using OutputFramed and closes
+// the iterator.
+func (i *Iterator) WriteTo(w io.Writer) (int64, error) {
+	return i.WriteToFormat(w, OutputFramed)
+}
+
+// WriteToFormat writes all remaining items to w using the given format
+// and closes the iterator. It returns the number of bytes written to w,
+// including the items written before an error occurred.
+func (i *Iterator) WriteToFormat(w io.Writer, format OutputFormat) (int64, error) {
+	if format > OutputRaw {
+		_ = i.Close()
+		return 0, ErrInvalidFormat
+	}
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	scratch := make([]byte, binary.MaxVarintLen64)
+	err := i.ForEach(func(data []byte) error {
+		switch format {
+		case OutputLines:
+			if bytes.IndexByte(data, '\n') > -1 {
+				return ErrNewlineInData
+			}
+			return writeLine(bw, data)
+		case OutputLinesEscaped:
+			return writeLine(bw, escapeLine(data))
+		case OutputRaw:
+			_, err := bw.Write(data)
+			return err
+		}
+		return encodeEntry(bw, scratch, data)
+	})
+	if e := bw.Flush(); err == nil {
+		err = e
+	}
+	return cw.n, err
+}
+
+func writeLine(w *bufio.Writer, data []byte) error {
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return w.WriteByte('\n')
+}
+
+func escapeLine(data []byte) []byte {
+	if bytes.IndexByte(data, '\n') < 0 && bytes.IndexByte(data, '\\') < 0 {
+		return data
+	}
+
+	esc := make([]byte, 0, len(data)+8)
+	for _, c := range data {
+		switch c {
+		case '\n':
+			esc = append(esc, '\\', 'n')
+		case '\\':
+			esc = append(esc, '\\', '\\')
+		default:
+			esc = append(esc, c)
+		}
+	}
+	return esc
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
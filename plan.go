@@ -0,0 +1,55 @@
+package extsort
+
+// SortPlan describes how a sort is expected to be executed, see Plan.
+type SortPlan struct {
+	// Runs is the number of runs flushed to disk.
+	Runs int
+	// MergePasses is the number of merges, including intermediate
+	// merges triggered by Options.MergeWhenRuns and the final merge.
+	MergePasses int
+	// FinalFanIn is the number of runs read by the final merge.
+	FinalFanIn int
+	// SectionBufferSize is the read buffer size per run in the final merge.
+	SectionBufferSize int
+	// DiskBytes is the estimated peak disk usage. It assumes that data is
+	// not compressed and is therefore an upper bound when compression is
+	// enabled.
+	DiskBytes int64
+}
+
+// Plan estimates the execution of a sort for an input of estInputBytes,
+// using opt. It does not touch the disk. The estimate accounts for
+// BufferSize, SpillThreshold, MemoryLimit, MergeWhenRuns and
+// MergeMemoryBudget, but not for TargetRunEntries, since the number of
+// entries is unknown.
+func Plan(opt *Options, estInputBytes int64) SortPlan {
+	opt = opt.norm()
+
+	runs := 1
+	if first := int64(opt.runLimit(true)); estInputBytes > first {
+		bufSize := int64(opt.runLimit(false))
+		runs += int((estInputBytes - first + bufSize - 1) / bufSize)
+	}
+	perRun := estInputBytes / int64(runs)
+
+	plan := SortPlan{Runs: runs, MergePasses: 1, DiskBytes: estInputBytes}
+	for run := 1; run <= runs; run++ {
+		plan.FinalFanIn++
+		if max := opt.MergeWhenRuns; max > 0 && plan.FinalFanIn > max {
+			// the old and the new file co-exist until the merge completes
+			if peak := 2 * int64(run) * perRun; peak > plan.DiskBytes {
+				plan.DiskBytes = peak
+			}
+			plan.MergePasses++
+			plan.FinalFanIn = 1
+		}
+	}
+	if budget := opt.MergeMemoryBudget; budget > 0 {
+		if plan.SectionBufferSize = budget / plan.FinalFanIn; plan.SectionBufferSize < minSectionBufferSize {
+			plan.SectionBufferSize = minSectionBufferSize
+		}
+	} else {
+		plan.SectionBufferSize = opt.BufferSize / (plan.FinalFanIn + 1)
+	}
+	return plan
+}
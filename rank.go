@@ -0,0 +1,52 @@
+package extsort
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ErrUnknownRank is returned by ValidateRank for chunks without a rank.
+var ErrUnknownRank = errors.New("extsort: unknown rank")
+
+// UnknownRank defines the position of chunks without a rank, see LessByRank.
+// Since a Less function cannot report errors, there is no policy to reject
+// unknown chunks while sorting. Use ValidateRank to reject them before they
+// are appended instead.
+type UnknownRank uint8
+
+// Supported positions for unknown ranks.
+const (
+	// UnknownLast orders chunks without a rank after all ranked ones.
+	UnknownLast UnknownRank = iota
+	// UnknownFirst orders chunks without a rank before all ranked ones.
+	UnknownFirst
+)
+
+// LessByRank returns a Less function which orders byte chunks by their
+// rank in the given table, lower ranks first. Chunks with equal ranks and
+// chunks without a rank are ordered lexically among each other. The table
+// must not be modified while in use.
+func LessByRank(rank map[string]int, unknown UnknownRank) Less {
+	return func(a, b []byte) bool {
+		ra, oka := rank[string(a)]
+		rb, okb := rank[string(b)]
+
+		switch {
+		case oka && okb && ra != rb:
+			return ra < rb
+		case oka != okb:
+			return oka != (unknown == UnknownFirst)
+		}
+		return bytes.Compare(a, b) < 0
+	}
+}
+
+// ValidateRank returns ErrUnknownRank if data has no rank in the given
+// table. It can be used to reject chunks before they are appended to a
+// sorter using LessByRank.
+func ValidateRank(rank map[string]int, data []byte) error {
+	if _, ok := rank[string(data)]; !ok {
+		return ErrUnknownRank
+	}
+	return nil
+}
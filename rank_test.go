@@ -0,0 +1,35 @@
+package extsort_test
+
+import (
+	"sort"
+
+	"github.com/bsm/extsort"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LessByRank", func() {
+	rank := map[string]int{"low": 1, "medium": 2, "high": 3, "max": 3}
+	data := []string{"medium", "zzz", "max", "aaa", "low", "high"}
+
+	sorted := func(unknown extsort.UnknownRank) []string {
+		less := extsort.LessByRank(rank, unknown)
+		res := append([]string(nil), data...)
+		sort.Slice(res, func(i, j int) bool { return less([]byte(res[i]), []byte(res[j])) })
+		return res
+	}
+
+	It("should order by rank", func() {
+		Expect(sorted(extsort.UnknownLast)).To(Equal([]string{"low", "medium", "high", "max", "aaa", "zzz"}))
+	})
+
+	It("should order unknown chunks first", func() {
+		Expect(sorted(extsort.UnknownFirst)).To(Equal([]string{"aaa", "zzz", "low", "medium", "high", "max"}))
+	})
+
+	It("should validate ranks", func() {
+		Expect(extsort.ValidateRank(rank, []byte("low"))).To(Succeed())
+		Expect(extsort.ValidateRank(rank, []byte("zzz"))).To(MatchError(extsort.ErrUnknownRank))
+	})
+})
@@ -0,0 +1,40 @@
+package extsort
+
+const (
+	sketchDepth = 4
+	sketchWidth = 1 << 12
+)
+
+// countMinSketch is an approximate frequency counter. Estimates never
+// undercount but may overcount due to hash collisions.
+type countMinSketch struct {
+	counts [sketchDepth][sketchWidth]uint64
+}
+
+func (s *countMinSketch) Add(data []byte) {
+	h1, h2 := sketchHash(data)
+	for i := uint64(0); i < sketchDepth; i++ {
+		s.counts[i][(h1+i*h2)%sketchWidth]++
+	}
+}
+
+func (s *countMinSketch) Count(data []byte) uint64 {
+	h1, h2 := sketchHash(data)
+	min := ^uint64(0)
+	for i := uint64(0); i < sketchDepth; i++ {
+		if n := s.counts[i][(h1+i*h2)%sketchWidth]; n < min {
+			min = n
+		}
+	}
+	return min
+}
+
+// sketchHash returns two independent-ish hashes derived from 64-bit FNV-1a.
+func sketchHash(data []byte) (uint64, uint64) {
+	h := uint64(14695981039346656037)
+	for _, c := range data {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	return h, (h >> 32) | (h << 32) | 1
+}
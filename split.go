@@ -0,0 +1,183 @@
+package extsort
+
+// SplitRanges splits the remaining output into up to n iterators over
+// contiguous, non-overlapping key ranges, in order. Together they cover
+// the remaining output exactly once and can be consumed concurrently.
+// Boundaries are chosen from quantiles of the largest section, which
+// requires an extra pass over the data. Fewer than n iterators are
+// returned if there are not enough distinct items. The original iterator
+// must not be advanced or closed while the returned ones are in use.
+//
+// The returned iterators share MaxOutputEntries, and the read buffers of
+// all of them share MergeMemoryBudget or, by default, BufferSize.
+//
+// Groups of duplicates defined by EqualWithin or DedupWindow may span
+// any boundary, SplitRanges returns ErrSplitUnsupported if either is used
+// with DedupGlobal.
+func (i *Iterator) SplitRanges(n int) ([]*Iterator, error) {
+	if i.err != nil {
+		return nil, i.err
+	}
+	if i.dedup && (i.equal != nil || i.window != nil) {
+		return nil, ErrSplitUnsupported
+	}
+
+	start := i.positions()
+	bounds, err := i.splitBounds(start, n)
+	if err != nil {
+		return nil, err
+	}
+
+	// find the start positions of each range in every section
+	const unset = -2
+	ranges := make([][]int64, len(bounds)+1)
+	ranges[0] = start
+	for j := range bounds {
+		ranges[j+1] = make([]int64, len(start))
+		for section, pos := range start {
+			if ranges[j+1][section] = unset; pos < 0 {
+				ranges[j+1][section] = -1
+			}
+		}
+	}
+	if len(bounds) != 0 {
+		last := ranges[len(bounds)]
+		if err := i.scanSections(start, func(section int, pos int64, data []byte) bool {
+			for j, bound := range bounds {
+				if ranges[j+1][section] == unset && !i.heap.less(data, bound) {
+					ranges[j+1][section] = pos
+				}
+			}
+			return last[section] == unset
+		}, func(section int) {
+			for j := range bounds {
+				if ranges[j+1][section] == unset {
+					ranges[j+1][section] = -1
+				}
+			}
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	opt := *i.opt
+	if opt.MergeMemoryBudget <= 0 {
+		opt.MergeMemoryBudget = opt.BufferSize
+	}
+	opt.MergeMemoryBudget /= len(ranges)
+
+	var shared *int64
+	if i.maxEntries > 0 {
+		shared = new(int64)
+		*shared = i.emitted
+		if i.shared != nil {
+			shared = i.shared
+		}
+	}
+
+	iters := make([]*Iterator, 0, len(ranges))
+	for j, pos := range ranges {
+		sub, err := i.subIterator(pos, &opt, shared)
+		if err != nil {
+			for _, it := range iters {
+				_ = it.Close()
+			}
+			return nil, err
+		}
+		if j < len(bounds) {
+			sub.until = bounds[j]
+		}
+		iters = append(iters, sub)
+	}
+	return iters, nil
+}
+
+// splitBounds returns up to n-1 strictly increasing boundary items from the
+// largest remaining section.
+func (i *Iterator) splitBounds(start []int64, n int) ([][]byte, error) {
+	largest, remaining := -1, int64(0)
+	for section, pos := range start {
+		if pos < 0 || section >= len(i.sizes) {
+			continue
+		}
+		if rem := i.sizes[section] - pos; rem > remaining {
+			largest, remaining = section, rem
+		}
+	}
+	if largest < 0 || n < 2 {
+		return nil, nil
+	}
+
+	var bounds [][]byte
+	only := make([]int64, len(start))
+	for section := range only {
+		only[section] = -1
+	}
+	only[largest] = start[largest]
+
+	err := i.scanSections(only, func(_ int, pos int64, data []byte) bool {
+		next := start[largest] + remaining*int64(len(bounds)+1)/int64(n)
+		if pos >= next && (len(bounds) == 0 || i.heap.less(bounds[len(bounds)-1], data)) {
+			bounds = append(bounds, data)
+		}
+		return len(bounds) < n-1
+	}, nil)
+	return bounds, err
+}
+
+// scanSections reads all sections from their start positions and calls fn
+// with the position of each item until fn returns false. The optional done
+// callback is called when a section is exhausted.
+func (i *Iterator) scanSections(start []int64, fn func(int, int64, []byte) bool, done func(int)) error {
+	tr, err := openTempReader(i.tr.ra, nil, i.tr.offsets, i.tr.codecs, i.opt)
+	if err != nil {
+		return err
+	}
+	defer tr.Close()
+
+	for section, pos := range start {
+		if err := tr.Seek(section, pos); err != nil {
+			return err
+		}
+		if pos < 0 {
+			continue
+		}
+
+		for {
+			pos := tr.Pos(section)
+			data, err := tr.ReadNext(section)
+			if err != nil {
+				return err
+			} else if data == nil {
+				if done != nil {
+					done(section)
+				}
+				break
+			} else if !fn(section, pos, data) {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// subIterator creates an iterator with the same settings, reading from
+// its own readers at the given positions.
+func (i *Iterator) subIterator(pos []int64, opt *Options, shared *int64) (*Iterator, error) {
+	tr, err := openTempReader(i.tr.ra, nil, i.tr.offsets, i.tr.codecs, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := newMergeIterator(tr, i.sizes, opt, i.heap.less)
+	sub.dedup = i.dedup
+	sub.bestEffort = i.bestEffort
+	sub.onError = i.onError
+	sub.maxEntries = i.maxEntries
+	if err := sub.seek(pos); err != nil {
+		_ = tr.Close()
+		return nil, err
+	}
+	sub.shared = shared
+	return sub, nil
+}
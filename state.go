@@ -0,0 +1,211 @@
+package extsort
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sync/atomic"
+)
+
+// ErrInvalidState is returned by LoadState when the input is not a valid
+// sorter state.
+var ErrInvalidState = errors.New("extsort: invalid state")
+
+var stateMagic = []byte("extsort\x01")
+
+// maxStateRuns bounds the number of runs accepted by LoadState.
+const maxStateRuns = 1 << 24
+
+const (
+	stateEnd byte = iota
+	stateEntry
+)
+
+// SaveState writes the state of the sorter to w, including all runs
+// flushed so far and the data which is still buffered in memory. The
+// sorter remains usable. Please note that the frequency sketch is not part
+// of the state.
+func (s *Sorter) SaveState(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.wait(); err != nil {
+		return err
+	}
+
+	var offsets []int64
+	var codecs []Compression
+	if s.tw != nil {
+		offsets, codecs = s.tw.offsets, s.tw.codecs
+	}
+
+	head := append([]byte(nil), stateMagic...)
+	head = appendUvarint(head, uint64(atomic.LoadInt64(&s.counters.appended)))
+	head = appendUvarint(head, uint64(len(s.runs)))
+	for _, n := range s.runs {
+		head = appendUvarint(head, uint64(n))
+	}
+	head = appendUvarint(head, uint64(len(offsets)))
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(head); err != nil {
+		return err
+	}
+
+	scratch := make([]byte, binary.MaxVarintLen64)
+	if len(offsets) != 0 {
+		tr, err := newTempReader(s.tw.Name(), offsets, codecs, s.opt)
+		if err != nil {
+			return err
+		}
+		defer tr.Close()
+
+		for section := range offsets {
+			for {
+				data, err := tr.ReadNext(section)
+				if err != nil {
+					return err
+				} else if data == nil {
+					break
+				}
+
+				if err := bw.WriteByte(stateEntry); err != nil {
+					return err
+				}
+				if err := encodeEntry(bw, scratch, data); err != nil {
+					return err
+				}
+			}
+			if err := bw.WriteByte(stateEnd); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := bw.Write(appendUvarint(nil, uint64(s.buf.Len()))); err != nil {
+		return err
+	}
+	for _, data := range s.buf.chunks {
+		if err := encodeEntry(bw, scratch, data); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// LoadState creates a new sorter from a state written by SaveState. Sorting
+// the restored sorter produces the same output as the original one, given
+// compatible options.
+func LoadState(r io.Reader, opt *Options) (*Sorter, error) {
+	s := New(opt)
+	if err := s.loadState(bufio.NewReader(r)); err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Sorter) loadState(r *bufio.Reader) error {
+	magic := make([]byte, len(stateMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, stateMagic) {
+		return ErrInvalidState
+	}
+
+	appended, err := binary.ReadUvarint(r)
+	if err != nil || appended > math.MaxInt64 {
+		return ErrInvalidState
+	}
+
+	numRuns, err := binary.ReadUvarint(r)
+	if err != nil || numRuns > maxStateRuns {
+		return ErrInvalidState
+	}
+	var runs []int64
+	for i := uint64(0); i < numRuns; i++ {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return ErrInvalidState
+		}
+		runs = append(runs, int64(n))
+	}
+
+	// each section holds at least one run
+	numSections, err := binary.ReadUvarint(r)
+	if err != nil || numSections > numRuns {
+		return ErrInvalidState
+	}
+	if err := s.loadSections(r, int(numSections)); err != nil {
+		return err
+	}
+
+	numBuffered, err := binary.ReadUvarint(r)
+	if err != nil {
+		return ErrInvalidState
+	}
+	for i := uint64(0); i < numBuffered; i++ {
+		data, err := decodeEntry(r)
+		if err != nil {
+			return ErrInvalidState
+		}
+		if err := s.Append(data); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.runs = append(runs, s.runs...)
+	s.spilled = s.spilled || len(runs) != 0
+	atomic.StoreInt64(&s.counters.appended, int64(appended))
+	return nil
+}
+
+func (s *Sorter) loadSections(r *bufio.Reader, n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.prepare(); err != nil {
+		return err
+	}
+
+	for section := 0; section < n; section++ {
+		if s.tw == nil {
+			tw, err := newTempWriter(s.opt)
+			if err != nil {
+				return err
+			}
+			s.tw = tw
+		}
+		if err := s.tw.Use(s.opt.Compression); err != nil {
+			return err
+		}
+
+		for {
+			kind, err := r.ReadByte()
+			if err != nil {
+				return ErrInvalidState
+			} else if kind == stateEnd {
+				break
+			} else if kind != stateEntry {
+				return ErrInvalidState
+			}
+
+			data, err := decodeEntry(r)
+			if err != nil {
+				return ErrInvalidState
+			}
+			if err := s.tw.Encode(data); err != nil {
+				return err
+			}
+		}
+		if err := s.tw.Flush(); err != nil {
+			return err
+		}
+		s.counters.trackSection(s.tw)
+	}
+	return nil
+}
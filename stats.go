@@ -0,0 +1,99 @@
+package extsort
+
+import "sync/atomic"
+
+// Stats contains sorting statistics.
+type Stats struct {
+	// Comparisons is the number of comparisons made while sorting runs
+	// and merging them. Only populated if Options.CountComparisons is set.
+	Comparisons int64
+
+	// CompressionRatio is the ratio between the encoded and the stored
+	// (compressed) size of all data written to disk, 0 if nothing was
+	// written yet.
+	CompressionRatio float64
+
+	// Reads is the number of entries read from disk while merging runs.
+	Reads int64
+
+	// BytesRead is the number of (uncompressed) bytes read from disk while
+	// merging runs, including framing.
+	BytesRead int64
+}
+
+// Metrics receives live updates, see Options.Metrics. Implementations must
+// be safe for concurrent use.
+type Metrics interface {
+	// IncRuns is called for every run written to disk.
+	IncRuns()
+	// AddBytesWritten is called with the number of (compressed) bytes
+	// written to disk for every run.
+	AddBytesWritten(n int64)
+	// ObserveMergePass is called with the number of merged sections for
+	// every merge, including MergeWhenRuns merges.
+	ObserveMergePass(fanIn int)
+}
+
+type counters struct {
+	metrics Metrics
+
+	comparisons int64
+	appended    int64
+	encoded     int64
+	stored      int64
+	reads       int64
+	bytesRead   int64
+}
+
+func (c *counters) Stats() Stats {
+	st := Stats{
+		Comparisons: atomic.LoadInt64(&c.comparisons),
+		Reads:       atomic.LoadInt64(&c.reads),
+		BytesRead:   atomic.LoadInt64(&c.bytesRead),
+	}
+	if stored := atomic.LoadInt64(&c.stored); stored > 0 {
+		st.CompressionRatio = float64(atomic.LoadInt64(&c.encoded)) / float64(stored)
+	}
+	return st
+}
+
+// trackSection accounts for the last section flushed by tw.
+func (c *counters) trackSection(tw *tempWriter) {
+	n := len(tw.offsets)
+	if n == 0 {
+		return
+	}
+
+	stored := tw.offsets[n-1]
+	if n > 1 {
+		stored -= tw.offsets[n-2]
+	}
+	atomic.AddInt64(&c.encoded, tw.sizes[n-1])
+	atomic.AddInt64(&c.stored, stored)
+	if c.metrics != nil {
+		c.metrics.AddBytesWritten(stored)
+	}
+}
+
+// countingLess wraps less to count each invocation.
+func (c *counters) countingLess(less Less) Less {
+	return func(a, b []byte) bool {
+		atomic.AddInt64(&c.comparisons, 1)
+		return less(a, b)
+	}
+}
+
+// observedLess wraps less to report each invocation to fn.
+func observedLess(less Less, fn func(a, b []byte, less bool)) Less {
+	return func(a, b []byte) bool {
+		ok := less(a, b)
+		fn(a, b, ok)
+		return ok
+	}
+}
+
+// trackRead accounts for a single entry of n bytes read from disk.
+func (c *counters) trackRead(n int64) {
+	atomic.AddInt64(&c.reads, 1)
+	atomic.AddInt64(&c.bytesRead, n)
+}
@@ -2,30 +2,158 @@ package extsort
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
+const tempFilePrefix = "extsort"
+
+const (
+	maxEntrySize  = math.MaxInt32
+	entryReadSize = 64 * 1024
+)
+
+// DefaultFileSuffix is the default suffix of temporary files.
+const DefaultFileSuffix = ".extsort"
+
+// CleanupWorkDir removes temporary files left behind in dir, e.g. by
+// crashed processes. Only regular files which match the naming pattern of
+// temporary files with the given suffix (see Options.FileSuffix) are
+// removed. An empty suffix defaults to DefaultFileSuffix.
+//
+// Files modified less than minAge ago are kept. Files are not checked for
+// ownership, so unless minAge exceeds the duration of any sort that may
+// share dir, CleanupWorkDir must only be called while no sorter is using it.
+func CleanupWorkDir(dir, suffix string, minAge time.Duration) error {
+	if suffix == "" {
+		suffix = DefaultFileSuffix
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-minAge)
+	for _, fi := range entries {
+		if !fi.Mode().IsRegular() || !isTempFileName(fi.Name(), suffix) {
+			continue
+		}
+		if fi.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// isTempFileName returns true if name is prefix + random digits + suffix.
+func isTempFileName(name, suffix string) bool {
+	if !strings.HasPrefix(name, tempFilePrefix) || !strings.HasSuffix(name, suffix) {
+		return false
+	}
+
+	rnd := name[len(tempFilePrefix):]
+	if len(rnd) <= len(suffix) {
+		return false
+	}
+	for _, c := range rnd[:len(rnd)-len(suffix)] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
 type tempWriter struct {
 	f *os.File
 	c compressedWriter
 	w *bufio.Writer
 
+	level   int
+	current Compression
+	writers map[Compression]compressedWriter
+
 	scratch []byte
 	offsets []int64
+	codecs  []Compression
+	sizes   []int64
+	written int64
 }
 
-func newTempWriter(dir string, compress Compression) (*tempWriter, error) {
-	f, err := ioutil.TempFile(dir, "extsort")
+func newTempWriter(opt *Options) (*tempWriter, error) {
+	var f *os.File
+	var err error
+	if opt.OpenTempFile != nil {
+		f, err = opt.OpenTempFile(opt.WorkDir)
+	} else {
+		f, err = ioutil.TempFile(opt.WorkDir, tempFilePrefix+"*"+opt.FileSuffix)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	c := compress.newWriter(f)
+	tw, err := newFileWriter(f, opt)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return nil, err
+	}
+	return tw, nil
+}
+
+// newFileWriter creates a writer for sections in f.
+func newFileWriter(f *os.File, opt *Options) (*tempWriter, error) {
+	compress, level := opt.Compression, opt.CompressionLevel
+	c, err := compress.newWriter(f, level)
+	if err != nil {
+		return nil, err
+	}
 	w := bufio.NewWriterSize(c, 1<<16) // 64k
-	return &tempWriter{f: f, c: c, w: w, scratch: make([]byte, binary.MaxVarintLen64)}, nil
+	return &tempWriter{
+		f: f,
+		c: c,
+		w: w,
+
+		level:   level,
+		current: compress,
+		writers: map[Compression]compressedWriter{compress: c},
+
+		scratch: make([]byte, binary.MaxVarintLen64),
+	}, nil
+}
+
+// Use switches the compression for the next section. It must only be
+// called before any data is written to the section.
+func (t *tempWriter) Use(compress Compression) error {
+	if compress == t.current {
+		return nil
+	}
+
+	c, ok := t.writers[compress]
+	if ok {
+		c.Reset(t.f)
+	} else {
+		var err error
+		if c, err = compress.newWriter(t.f, t.level); err != nil {
+			return err
+		}
+		t.writers[compress] = c
+	}
+
+	t.current = compress
+	t.c = c
+	t.w.Reset(c)
+	return nil
 }
 
 func (t *tempWriter) Name() string {
@@ -33,18 +161,13 @@ func (t *tempWriter) Name() string {
 }
 
 func (t *tempWriter) Encode(p []byte) error {
-	n := binary.PutUvarint(t.scratch, uint64(len(p)))
-	if _, err := t.Write(t.scratch[:n]); err != nil {
-		return err
-	}
-	if _, err := t.Write(p); err != nil {
-		return err
-	}
-	return nil
+	return encodeEntry(t, t.scratch, p)
 }
 
 func (t *tempWriter) Write(p []byte) (int, error) {
-	return t.w.Write(p)
+	n, err := t.w.Write(p)
+	t.written += int64(n)
+	return n, err
 }
 
 func (t *tempWriter) Flush() error {
@@ -61,6 +184,9 @@ func (t *tempWriter) Flush() error {
 	}
 
 	t.offsets = append(t.offsets, pos)
+	t.codecs = append(t.codecs, t.current)
+	t.sizes = append(t.sizes, t.written)
+	t.written = 0
 	t.c.Reset(t.f)
 	t.w.Reset(t.c)
 
@@ -80,76 +206,261 @@ func (t *tempWriter) Close() (err error) {
 	return
 }
 
+// EncodeEntry writes a single data chunk to w, using the same framing as
+// temporary files: the length of the chunk as an uvarint, followed by the
+// chunk itself.
+func EncodeEntry(w io.Writer, data []byte) error {
+	return encodeEntry(w, make([]byte, binary.MaxVarintLen64), data)
+}
+
+// DecodeEntry reads a single data chunk from r, as written by EncodeEntry.
+// It returns io.EOF if r is exhausted before the start of an entry and
+// io.ErrUnexpectedEOF if an entry is truncated. Lengths beyond 2GiB are
+// rejected with ErrInvalidEntry. Readers which do not
+// implement io.ByteReader are read byte-by-byte to avoid reading past the
+// end of the entry.
+func DecodeEntry(r io.Reader) ([]byte, error) {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = &singleByteReader{Reader: r}
+	}
+	return decodeEntry(br)
+}
+
+func encodeEntry(w io.Writer, scratch, data []byte) error {
+	n := binary.PutUvarint(scratch, uint64(len(data)))
+	if _, err := w.Write(scratch[:n]); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return nil
+}
+
+func decodeEntry(r byteReader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if n > maxEntrySize {
+		return nil, ErrInvalidEntry
+	}
+
+	// large entries are read incrementally, to avoid allocating
+	// memory for corrupt lengths before the data is seen
+	if n > entryReadSize {
+		buf := bytes.NewBuffer(make([]byte, 0, entryReadSize))
+		if _, err := io.CopyN(buf, r, int64(n)); err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	data := make([]byte, int(n))
+	if _, err := io.ReadFull(r, data); err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+type singleByteReader struct {
+	io.Reader
+	b [1]byte
+}
+
+func (r *singleByteReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(r.Reader, r.b[:]); err != nil {
+		return 0, err
+	}
+	return r.b[0], nil
+}
+
+func encodedLen(p []byte) int {
+	n := len(p) + 1
+	for x := uint64(len(p)); x >= 0x80; x >>= 7 {
+		n++
+	}
+	return n
+}
+
 // --------------------------------------------------------------------
 
 type tempReader struct {
-	f *os.File
+	ra io.ReaderAt
+	f  io.Closer
+
+	offsets []int64
+	codecs  []Compression
+	slimits []int
 
 	readers  []io.ReadCloser
 	sections []*bufio.Reader
+	pos      []int64
+
+	counters *counters
 }
 
-func newTempReader(name string, offsets []int64, bufSize int, compress Compression) (*tempReader, error) {
+func newTempReader(name string, offsets []int64, codecs []Compression, opt *Options) (*tempReader, error) {
 	f, err := os.Open(name)
 	if err != nil {
 		return nil, err
 	}
+	return openTempReader(f, f, offsets, codecs, opt)
+}
 
+// openTempReader creates a reader for the sections stored in ra. The
+// optional closer c is closed together with the reader.
+func openTempReader(ra io.ReaderAt, c io.Closer, offsets []int64, codecs []Compression, opt *Options) (*tempReader, error) {
 	r := &tempReader{
-		f: f,
+		ra: ra,
+		f:  c,
 
-		readers:  make([]io.ReadCloser, 0, len(offsets)),
-		sections: make([]*bufio.Reader, 0, len(offsets)),
+		offsets: offsets,
+		codecs:  codecs,
+		slimits: sectionBufferSizes(offsets, opt),
+
+		readers:  make([]io.ReadCloser, len(offsets)),
+		sections: make([]*bufio.Reader, len(offsets)),
+		pos:      make([]int64, len(offsets)),
 	}
-	slimit := bufSize / (len(offsets) + 1)
-	offset := int64(0)
-	for _, next := range offsets {
-		crd, err := compress.newReader(io.NewSectionReader(r.f, offset, next-offset))
-		if err != nil {
+	for section := range offsets {
+		if err := r.Seek(section, 0); err != nil {
 			_ = r.Close()
 			return nil, err
 		}
-		r.sections = append(r.sections, bufio.NewReaderSize(crd, slimit))
-		r.readers = append(r.readers, crd)
-		offset = next
 	}
 
 	return r, nil
 }
 
+// minSectionBufferSize is the minimum read buffer size per section with
+// Options.MergeMemoryBudget.
+const minSectionBufferSize = 4096
+
+// sectionBufferSizes returns the read buffer sizes for each section. By
+// default, the BufferSize is split evenly, with MergeMemoryBudget the
+// budget is split proportionally to the stored size of each section.
+func sectionBufferSizes(offsets []int64, opt *Options) []int {
+	sizes := make([]int, len(offsets))
+	if len(offsets) == 0 {
+		return sizes
+	}
+
+	budget, total := int64(opt.MergeMemoryBudget), offsets[len(offsets)-1]
+	for section := range offsets {
+		if budget <= 0 || total <= 0 {
+			sizes[section] = opt.BufferSize / (len(offsets) + 1)
+			continue
+		}
+
+		size := offsets[section]
+		if section > 0 {
+			size -= offsets[section-1]
+		}
+		if sizes[section] = int(float64(budget) * float64(size) / float64(total)); sizes[section] < minSectionBufferSize {
+			sizes[section] = minSectionBufferSize
+		}
+	}
+	return sizes
+}
+
 func (t *tempReader) NumSections() int {
 	return len(t.sections)
 }
 
+// Pos returns the number of (uncompressed) bytes consumed from a section
+// or -1 if the section has been exhausted.
+func (t *tempReader) Pos(section int) int64 {
+	if t.sections[section] == nil {
+		return -1
+	}
+	return t.pos[section]
+}
+
+// Seek re-opens a section and skips to the (uncompressed) position pos.
+// A negative pos marks the section as exhausted.
+func (t *tempReader) Seek(section int, pos int64) error {
+	if crd := t.readers[section]; crd != nil {
+		t.readers[section] = nil
+		if err := crd.Close(); err != nil {
+			return err
+		}
+	}
+	t.sections[section] = nil
+	t.pos[section] = 0
+
+	if pos < 0 {
+		return nil
+	}
+
+	offset := int64(0)
+	if section > 0 {
+		offset = t.offsets[section-1]
+	}
+	crd, err := t.codecs[section].newReader(io.NewSectionReader(t.ra, offset, t.offsets[section]-offset))
+	if err != nil {
+		return err
+	}
+	t.readers[section] = crd
+
+	r := bufio.NewReaderSize(crd, t.slimits[section])
+	for pos > 0 {
+		n, err := r.Discard(int(pos))
+		pos -= int64(n)
+		t.pos[section] += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	t.sections[section] = r
+	return nil
+}
+
 func (t *tempReader) ReadNext(section int) ([]byte, error) {
 	r := t.sections[section]
 	if r == nil {
 		return nil, nil
 	}
 
-	n, err := binary.ReadUvarint(r)
+	data, err := decodeEntry(r)
 	if err == io.EOF {
 		t.sections[section] = nil
 		return nil, nil
 	} else if err != nil {
 		return nil, err
 	}
-
-	data := make([]byte, int(n))
-	if _, err := io.ReadFull(r, data); err != nil {
-		return nil, err
+	n := int64(encodedLen(data))
+	t.pos[section] += n
+	if t.counters != nil {
+		t.counters.trackRead(n)
 	}
 	return data, nil
 }
 
 func (t *tempReader) Close() (err error) {
 	for _, crd := range t.readers {
+		if crd == nil {
+			continue
+		}
 		if e := crd.Close(); e != nil {
 			err = e
 		}
 	}
-	if e := t.f.Close(); e != nil {
-		err = e
+	if t.f != nil {
+		if e := t.f.Close(); e != nil {
+			err = e
+		}
 	}
 	return
 }
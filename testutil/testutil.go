@@ -0,0 +1,38 @@
+// Package testutil contains helpers for reproducible tests and benchmarks
+// of the extsort package.
+package testutil
+
+import (
+	"math/rand"
+
+	"github.com/bsm/extsort"
+)
+
+// GenerateKeys returns n pseudo-random keys of keyLen bytes each. The same
+// seed always generates the same keys.
+func GenerateKeys(n, keyLen int, seed int64) [][]byte {
+	keys := make([][]byte, 0, n)
+	_ = generate(n, keyLen, seed, func(key []byte) error {
+		keys = append(keys, append([]byte(nil), key...))
+		return nil
+	})
+	return keys
+}
+
+// FeedSorter appends the same keys as GenerateKeys to the sorter, without
+// holding them in memory.
+func FeedSorter(s *extsort.Sorter, n, keyLen int, seed int64) error {
+	return generate(n, keyLen, seed, s.Append)
+}
+
+func generate(n, keyLen int, seed int64, fn func([]byte) error) error {
+	rnd := rand.New(rand.NewSource(seed))
+	key := make([]byte, keyLen)
+	for i := 0; i < n; i++ {
+		_, _ = rnd.Read(key)
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package extsort
+
+import (
+	"fmt"
+	"io"
+)
+
+// VerifyRun checks the sorted sections stored in ra, as described by
+// offsets and codecs (see Iterator.Offsets and Iterator.Codecs). It decodes
+// every entry and verifies that each section is ordered according to
+// opt.Less, returning ErrOrderViolation otherwise. If codecs is nil, all
+// sections are expected to be compressed with opt.Compression.
+func VerifyRun(ra io.ReaderAt, offsets []int64, codecs []Compression, opt *Options) error {
+	opt = opt.norm()
+
+	if codecs == nil {
+		codecs = make([]Compression, len(offsets))
+		for section := range codecs {
+			codecs[section] = opt.Compression
+		}
+	} else if len(codecs) != len(offsets) {
+		return fmt.Errorf("extsort: %d codecs given for %d sections", len(codecs), len(offsets))
+	}
+
+	tr, err := openTempReader(ra, nil, offsets, codecs, opt)
+	if err != nil {
+		return err
+	}
+	defer tr.Close()
+
+	for section := range offsets {
+		var prev []byte
+		for {
+			data, err := tr.ReadNext(section)
+			if err != nil {
+				return err
+			} else if data == nil {
+				break
+			}
+
+			if prev != nil && opt.Less(data, prev) {
+				return ErrOrderViolation
+			}
+			prev = data
+		}
+	}
+	return nil
+}